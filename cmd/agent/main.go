@@ -1,151 +1,208 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
-	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
-	"net/url"
-	"os"
 	"os/signal"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/region23/go-musthave-devops/internal/agent/collector"
+	"github.com/region23/go-musthave-devops/internal/agent/retry"
+	"github.com/region23/go-musthave-devops/internal/agent/spool"
 	"github.com/region23/go-musthave-devops/internal/serializers"
 	"github.com/rs/zerolog/log"
-
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
 )
 
 type Config struct {
-	Address        string        `env:"ADDRESS"`
-	ReportInterval time.Duration `env:"REPORT_INTERVAL"`
-	PollInterval   time.Duration `env:"POLL_INTERVAL"`
-	Key            string        `env:"KEY"`
+	Address            string        `env:"ADDRESS"`
+	ReportInterval     time.Duration `env:"REPORT_INTERVAL"`
+	PollInterval       time.Duration `env:"POLL_INTERVAL"`
+	Collectors         string        `env:"COLLECTORS"`
+	CollectorIntervals string        `env:"COLLECTOR_INTERVALS"`
+	FSInclude          string        `env:"FS_INCLUDE"`
+	FSExclude          string        `env:"FS_EXCLUDE"`
+	DiskIOInclude      string        `env:"DISKIO_INCLUDE"`
+	DiskIOExclude      string        `env:"DISKIO_EXCLUDE"`
+	NetInclude         string        `env:"NET_INCLUDE"`
+	NetExclude         string        `env:"NET_EXCLUDE"`
+	ProcessNames       string        `env:"PROCESS_NAMES"`
+	ProcessPIDFiles    string        `env:"PROCESS_PID_FILES"`
+	ProcessCgroups     string        `env:"PROCESS_CGROUPS"`
+	CgroupRoot         string        `env:"CGROUP_ROOT"`
+	CgroupPaths        string        `env:"CGROUP_PATHS"`
+	Key                string        `env:"KEY"`
+	AgentID            string        `env:"AGENT_ID"`
+	LegacyHash         bool          `env:"LEGACY_HASH"`
+	Labels             string        `env:"LABELS"`
+	SpoolDir           string        `env:"SPOOL_DIR"`
+	SpoolMaxSize       int64         `env:"SPOOL_MAX_SIZE"`
+	SpoolMaxAge        time.Duration `env:"SPOOL_MAX_AGE"`
+	RequestTimeout     time.Duration `env:"REQUEST_TIMEOUT"`
+	RetryAttempts      int           `env:"RETRY_MAX_ATTEMPTS"`
+	RetryBaseDelay     time.Duration `env:"RETRY_BASE_DELAY"`
+	RetryMaxDelay      time.Duration `env:"RETRY_MAX_DELAY"`
+	RetryJitter        float64       `env:"RETRY_JITTER"`
+	RetryStatuses      string        `env:"RETRY_STATUSES"`
+	ShutdownTimeout    time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	Transport          string        `env:"TRANSPORT"`
+	GRPCAddress        string        `env:"GRPC_ADDRESS"`
+	CryptoKey          string        `env:"CRYPTO_KEY"`
+	TLS                bool          `env:"TLS"`
+	TLSCA              string        `env:"TLS_CA"`
+	TLSCert            string        `env:"TLS_CERT"`
+	TLSKey             string        `env:"TLS_KEY"`
+	TLSServerName      string        `env:"TLS_SERVER_NAME"`
 }
 
 var cfg Config = Config{}
 
+// Очередь неотправленных батчей, nil если очередь выключена
+var batchSpool *spool.Spool
+
+// Транспорт и политика повторов, общие для всех отправок
+var (
+	sender      transport
+	retryPolicy retry.Policy
+)
+
+// Признак того, что предыдущая отправка ещё не завершилась
+var sending int32
+
 func init() {
 	flag.StringVar(&cfg.Address, "a", "127.0.0.1:8080", "server address")
 	flag.DurationVar(&cfg.ReportInterval, "r", 10*time.Second, "report interval")
 	flag.DurationVar(&cfg.PollInterval, "p", 2*time.Second, "poll interval")
+	flag.StringVar(&cfg.Collectors, "collectors", "runtime,system,filesystem,diskio,network,tcp,process,cgroup", "comma separated collectors to enable")
+	flag.StringVar(&cfg.CollectorIntervals, "collector-intervals", "", "per collector poll intervals, e.g. system=10s,runtime=2s")
+	flag.StringVar(&cfg.FSInclude, "fs-include", "", "comma separated mountpoint patterns to collect (empty collects all)")
+	flag.StringVar(&cfg.FSExclude, "fs-exclude", "", "comma separated mountpoint patterns to skip")
+	flag.StringVar(&cfg.DiskIOInclude, "diskio-include", "", "comma separated block device patterns to collect (empty collects all)")
+	flag.StringVar(&cfg.DiskIOExclude, "diskio-exclude", "loop*,ram*", "comma separated block device patterns to skip")
+	flag.StringVar(&cfg.NetInclude, "net-include", "", "comma separated network interface patterns to collect (empty collects all)")
+	flag.StringVar(&cfg.NetExclude, "net-exclude", "lo", "comma separated network interface patterns to skip")
+	flag.StringVar(&cfg.ProcessNames, "process-names", "", "comma separated process name patterns to track, e.g. nginx*,postgres")
+	flag.StringVar(&cfg.ProcessPIDFiles, "process-pid-files", "", "comma separated PID files of processes to track")
+	flag.StringVar(&cfg.ProcessCgroups, "process-cgroups", "", "comma separated cgroup directories whose processes to track")
+	flag.StringVar(&cfg.CgroupRoot, "cgroup-root", "/sys/fs/cgroup", "cgroup filesystem mount point")
+	flag.StringVar(&cfg.CgroupPaths, "cgroup-paths", "", "comma separated cgroup paths relative to the cgroup root (empty collects the agent's own cgroup)")
 	flag.StringVar(&cfg.Key, "k", "", "key for hashing")
+	flag.StringVar(&cfg.AgentID, "agent-id", "", "agent ID sent to the server to pick the hashing key")
+	flag.BoolVar(&cfg.LegacyHash, "legacy-hash", false, "hash every metric instead of signing the whole request body")
+	flag.StringVar(&cfg.Labels, "l", "", "static labels for all metrics, e.g. host=web1,env=prod")
+	flag.StringVar(&cfg.SpoolDir, "spool-dir", "", "directory for batches that failed to send (empty disables spooling)")
+	flag.Int64Var(&cfg.SpoolMaxSize, "spool-max-size", 64<<20, "max total size of spooled batches in bytes")
+	flag.DurationVar(&cfg.SpoolMaxAge, "spool-max-age", 24*time.Hour, "max age of spooled batches")
+	flag.DurationVar(&cfg.RequestTimeout, "request-timeout", 5*time.Second, "timeout of a single request to the server")
+	flag.IntVar(&cfg.RetryAttempts, "retry-max-attempts", 3, "max attempts to send a batch, including the first one")
+	flag.DurationVar(&cfg.RetryBaseDelay, "retry-base-delay", time.Second, "delay before the first retry, doubled on each next one")
+	flag.DurationVar(&cfg.RetryMaxDelay, "retry-max-delay", 5*time.Second, "max delay between retries")
+	flag.Float64Var(&cfg.RetryJitter, "retry-jitter", 0.2, "random fraction of retry delay, from 0 to 1")
+	flag.StringVar(&cfg.RetryStatuses, "retry-statuses", "429,502,503,504", "comma separated HTTP statuses to retry")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 5*time.Second, "time to finish collecting and send the last batch on shutdown")
+	flag.StringVar(&cfg.Transport, "transport", "http", "transport to send metrics: http or grpc")
+	flag.StringVar(&cfg.GRPCAddress, "grpc-address", "127.0.0.1:3200", "gRPC server address")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "path to PEM file with server public RSA key to encrypt requests")
+	flag.BoolVar(&cfg.TLS, "tls", false, "connect to the server over TLS (implied by other -tls-* flags)")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "path to PEM CA bundle to verify the server certificate")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "path to PEM client certificate for mutual TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "path to PEM client private key for mutual TLS")
+	flag.StringVar(&cfg.TLSServerName, "tls-server-name", "", "override server name to verify the server certificate against")
 }
 
-func getMainMetrics(metrics *serializers.Metrics) {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-
-	metrics.Add("Alloc", "gauge", memStats.Alloc)
-	metrics.Add("BuckHashSys", "gauge", memStats.BuckHashSys)
-	metrics.Add("Frees", "gauge", memStats.Frees)
-	metrics.Add("GCCPUFraction", "gauge", memStats.GCCPUFraction)
-	metrics.Add("GCSys", "gauge", memStats.GCSys)
-	metrics.Add("HeapAlloc", "gauge", memStats.HeapAlloc)
-	metrics.Add("HeapIdle", "gauge", memStats.HeapIdle)
-	metrics.Add("HeapInuse", "gauge", memStats.HeapInuse)
-	metrics.Add("HeapObjects", "gauge", memStats.HeapObjects)
-	metrics.Add("HeapReleased", "gauge", memStats.HeapReleased)
-	metrics.Add("HeapSys", "gauge", memStats.HeapSys)
-	metrics.Add("LastGC", "gauge", memStats.LastGC)
-	metrics.Add("Lookups", "gauge", memStats.Lookups)
-	metrics.Add("MCacheInuse", "gauge", memStats.MCacheInuse)
-	metrics.Add("MCacheSys", "gauge", memStats.MCacheSys)
-	metrics.Add("MSpanInuse", "gauge", memStats.MSpanInuse)
-	metrics.Add("MSpanSys", "gauge", memStats.MSpanSys)
-	metrics.Add("Mallocs", "gauge", memStats.Mallocs)
-	metrics.Add("NextGC", "gauge", memStats.NextGC)
-	metrics.Add("NumForcedGC", "gauge", memStats.NumForcedGC)
-	metrics.Add("NumGC", "gauge", memStats.NumGC)
-	metrics.Add("OtherSys", "gauge", memStats.OtherSys)
-	metrics.Add("PauseTotalNs", "gauge", memStats.PauseTotalNs)
-	metrics.Add("StackInuse", "gauge", memStats.StackInuse)
-	metrics.Add("StackSys", "gauge", memStats.StackSys)
-	metrics.Add("Sys", "gauge", memStats.Sys)
-	metrics.Add("TotalAlloc", "gauge", memStats.TotalAlloc)
-
-	s1 := rand.NewSource(time.Now().UnixNano())
-	r1 := rand.New(s1)
-	metrics.Add("RandomValue", "gauge", r1.Float64())
-
-	var val int64 = 1
-	pollCount, exist := metrics.Get("PollCount")
-	if exist {
-		val = *pollCount.Delta + 1
-	}
-	metrics.Add("PollCount", "counter", val)
-}
-
-func getGopsUitilMetrics(metrics *serializers.Metrics) {
-	cpuUtilization, err := cpu.Percent(time.Second*10, true)
-	if err != nil {
-		log.Error().Err(err).Msg("При получении процента загрузки процессоров возникла ошибка")
+// Отправляем метрику на сервер
+func sendMetric(ctx context.Context, metrics *serializers.Metrics) error {
+	// не копим горутины, если сервер отвечает медленнее, чем наступает время следующей отправки
+	if !atomic.CompareAndSwapInt32(&sending, 0, 1) {
+		log.Warn().Msg("Предыдущая отправка ещё не завершилась, пропускаем")
+		return nil
 	}
+	defer atomic.StoreInt32(&sending, 0)
 
-	for i := 0; i < len(cpuUtilization); i++ {
-		metrics.Add(fmt.Sprintf("%s%d", "CPUutilization", i+1), "gauge", cpuUtilization[i])
+	if batchSpool != nil {
+		reportSpoolDepth(metrics)
 	}
 
-	v, err := mem.VirtualMemory()
+	var err error
+	batch := metrics.GetAll()
+
+	if batchSpool != nil {
+		err = sendWithSpool(ctx, batch)
+	} else {
+		err = postBatch(ctx, batch)
+	}
 
 	if err != nil {
-		log.Error().Err(err).Msg("При получении данных о виртуальной памяти возникла ошибка")
+		return err
 	}
 
-	metrics.Add("TotalMemory", "gauge", v.Total)
-	metrics.Add("FreeMemory", "gauge", v.Free)
+	// После отправки сбрасываем счётчики
+	metrics.Sent(batch)
+
+	return nil
 }
 
-// Отправляем метрику на сервер
-func sendMetric(metrics *serializers.Metrics) error {
-	u := url.URL{
-		Scheme: "http",
-		Host:   cfg.Address,
-		Path:   "updates",
+// Отправляем батч, а если сервер недоступен - сохраняем его в очередь на диске.
+// Пока в очереди есть батчи, новый встаёт за ними, чтобы сохранить порядок отправки.
+func sendWithSpool(ctx context.Context, batch []serializers.Metric) error {
+	count, _, err := batchSpool.Depth()
+	if err != nil {
+		return err
 	}
 
-	postBody, err := json.Marshal(metrics.GetAll())
+	if count > 0 {
+		if err := pushToSpool(batch); err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
+		err := batchSpool.Replay(func(data []byte) error {
+			var spooled []serializers.Metric
+			if err := json.Unmarshal(data, &spooled); err != nil {
+				// повреждённый батч отправить не получится, выбрасываем его из очереди
+				log.Error().Err(err).Msg("Не смогли прочитать батч из очереди")
+				return nil
+			}
+			return postBatch(ctx, spooled)
+		})
+		if err != nil {
+			log.Warn().Err(err).Msg("Не смогли отправить батчи из очереди")
+		}
+
+		return nil
 	}
 
-	responseBody := bytes.NewBuffer(postBody)
-	request, err := http.NewRequest(http.MethodPost, u.String(), responseBody)
-	request.Header.Set("Content-Type", "application/json")
-	if err != nil {
-		return err
+	if err := postBatch(ctx, batch); err != nil {
+		log.Warn().Err(err).Msg("Сервер недоступен, сохраняем батч в очередь")
+		return pushToSpool(batch)
 	}
 
-	client := &http.Client{}
-	// отправляем запрос
-	response, err := client.Do(request)
+	return nil
+}
+
+// Сохраняем батч в очередь на диске
+func pushToSpool(batch []serializers.Metric) error {
+	data, err := json.Marshal(batch)
 	if err != nil {
 		return err
 	}
-	// печатаем код ответа
-	log.Debug().Msgf("Статус-код %v", response.Status)
-	defer response.Body.Close()
 
-	// читаем поток из тела ответа
-	body, err := io.ReadAll(response.Body)
+	return batchSpool.Push(data)
+}
+
+// Добавляем в коллекцию метрики о размере очереди неотправленных батчей
+func reportSpoolDepth(metrics *serializers.Metrics) {
+	count, size, err := batchSpool.Depth()
 	if err != nil {
-		log.Error().Err(err).Msg("Ошибка при чтении ответа")
+		log.Error().Err(err).Msg("Не смогли получить размер очереди")
+		return
 	}
-	// и печатаем его
-	log.Debug().Msg(string(body))
-
-	// После отправки сбрасываем счётчик
-	metrics.Add("PollCount", "counter", 1)
 
-	return nil
+	metrics.Add("SpoolBatches", "gauge", count)
+	metrics.Add("SpoolBytes", "gauge", size)
 }
 
 func main() {
@@ -155,23 +212,148 @@ func main() {
 		log.Error().Err(err).Msgf("%+v\n", err)
 	}
 
-	metrics := serializers.InitMetrics(cfg.Key)
+	labels, err := serializers.ParseLabels(cfg.Labels)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли разобрать метки")
+	}
 
-	osSigChan := make(chan os.Signal, 1)
-	signal.Notify(osSigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	// по HTTP подписываем тело запроса целиком, у gRPC тела нет - там
+	// остаются хэши отдельных метрик
+	metricKey := ""
+	if cfg.LegacyHash || cfg.Transport == "grpc" {
+		metricKey = cfg.Key
+	}
+	metrics := serializers.InitMetrics(metricKey, labels)
+
+	retryStatuses, err := retry.ParseStatuses(cfg.RetryStatuses)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли разобрать список повторяемых статусов")
+	}
+
+	sender, err = newTransport(cfg.Transport)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли инициализировать транспорт")
+	}
+	defer sender.Close()
+
+	retryPolicy = retry.Policy{
+		MaxAttempts:       cfg.RetryAttempts,
+		BaseDelay:         cfg.RetryBaseDelay,
+		MaxDelay:          cfg.RetryMaxDelay,
+		Jitter:            cfg.RetryJitter,
+		RetryableStatuses: retryStatuses,
+	}
+
+	if cfg.SpoolDir != "" {
+		batchSpool, err = spool.New(cfg.SpoolDir, cfg.SpoolMaxSize, cfg.SpoolMaxAge)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли инициализировать очередь батчей")
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	collectors, err := newCollectors()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли настроить сборщики метрик")
+	}
+
+	var collecting, senders sync.WaitGroup
+	collector.Start(ctx, collectors, metrics, &collecting)
 
-	pollTick := time.NewTicker(cfg.PollInterval)
 	reportTick := time.NewTicker(cfg.ReportInterval)
 	for {
 		select {
-		case <-pollTick.C:
-			go getMainMetrics(metrics)
-			go getGopsUitilMetrics(metrics)
 		case <-reportTick.C:
-			go sendMetric(metrics)
-		case <-osSigChan:
-			os.Exit(0)
+			senders.Add(1)
+			go func() {
+				defer senders.Done()
+				sendMetric(ctx, metrics)
+			}()
+		case <-ctx.Done():
+			reportTick.Stop()
+			shutdown(metrics, &collecting, &senders)
+			return
+		}
+	}
+
+}
+
+// Регистрируем все сборщики и выбираем включённые в конфиге
+func newCollectors() ([]collector.Collector, error) {
+	mountpoints, err := collector.NewFilter(cfg.FSInclude, cfg.FSExclude)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := collector.NewFilter(cfg.DiskIOInclude, cfg.DiskIOExclude)
+	if err != nil {
+		return nil, err
+	}
+	interfaces, err := collector.NewFilter(cfg.NetInclude, cfg.NetExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	processes, err := collector.NewProcess(collector.ProcessSelectors{
+		Names:    collector.ParseNames(cfg.ProcessNames),
+		PIDFiles: collector.ParseNames(cfg.ProcessPIDFiles),
+		Cgroups:  collector.ParseNames(cfg.ProcessCgroups),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registry := collector.NewRegistry()
+	for _, c := range []collector.Collector{
+		collector.NewRuntime(),
+		collector.NewSystem(),
+		collector.NewFilesystem(mountpoints),
+		collector.NewDiskIO(devices),
+		collector.NewNetwork(interfaces),
+		collector.NewTCP(),
+		processes,
+		collector.NewCgroup(cfg.CgroupRoot, collector.ParseNames(cfg.CgroupPaths)),
+	} {
+		if err := registry.Register(c); err != nil {
+			return nil, err
 		}
 	}
 
+	intervals, err := collector.ParseIntervals(cfg.CollectorIntervals)
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.Select(collector.ParseNames(cfg.Collectors), intervals, cfg.PollInterval)
+}
+
+// Дожидаемся завершения сборщиков и текущих отправок и отправляем последний батч.
+// Всё вместе занимает не дольше cfg.ShutdownTimeout.
+func shutdown(metrics *serializers.Metrics, collectors, senders *sync.WaitGroup) {
+	log.Info().Msg("Останавливаем агента...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		collectors.Wait()
+		senders.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Msg("Не дождались завершения сборщиков метрик")
+		return
+	}
+
+	if err := sendMetric(ctx, metrics); err != nil {
+		log.Error().Err(err).Msg("Не смогли отправить последний батч")
+		return
+	}
+
+	log.Info().Msg("Последний батч отправлен")
 }
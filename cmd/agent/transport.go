@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/region23/go-musthave-devops/internal/agent/retry"
+	"github.com/region23/go-musthave-devops/internal/encryption"
+	pb "github.com/region23/go-musthave-devops/internal/proto"
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/tlsconfig"
+)
+
+// Транспорт, которым агент отправляет батч метрик на сервер.
+// Send возвращает ошибку, только если батч стоит отправить повторно.
+type transport interface {
+	Send(ctx context.Context, batch []serializers.Metric) error
+	Close() error
+}
+
+func newTransport(name string) (transport, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS || cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSServerName != "" {
+		var err error
+		tlsConfig, err = tlsconfig.Client(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey, cfg.TLSServerName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch name {
+	case "http":
+		t := &httpTransport{
+			client: &http.Client{Timeout: cfg.RequestTimeout},
+			scheme: "http",
+		}
+		if tlsConfig != nil {
+			t.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+			t.scheme = "https"
+		}
+		if cfg.CryptoKey != "" {
+			key, err := encryption.LoadPublicKey(cfg.CryptoKey)
+			if err != nil {
+				return nil, err
+			}
+			t.publicKey = key
+		}
+		return t, nil
+	case "grpc":
+		if cfg.CryptoKey != "" {
+			return nil, errors.New("шифрование ключом сервера поддерживается только для транспорта http")
+		}
+		creds := insecure.NewCredentials()
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		conn, err := grpc.Dial(cfg.GRPCAddress, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		return &grpcTransport{conn: conn, client: pb.NewMetricsClient(conn)}, nil
+	default:
+		return nil, fmt.Errorf("неизвестный транспорт %q, ожидается http или grpc", name)
+	}
+}
+
+// Отправляем батч метрик на сервер, повторяя попытки согласно retryPolicy
+func postBatch(ctx context.Context, batch []serializers.Metric) error {
+	return retryPolicy.Do(ctx, func(ctx context.Context) error {
+		return sender.Send(ctx, batch)
+	})
+}
+
+// Отправка батча в JSON на ручку /updates
+type httpTransport struct {
+	client *http.Client
+	scheme string
+	// открытый ключ сервера для шифрования тела запроса, может быть nil
+	publicKey *rsa.PublicKey
+}
+
+// Одна попытка отправки батча. Ответ 5xx или статус из списка повторяемых
+// считаем недоступностью сервера
+func (t *httpTransport) Send(ctx context.Context, batch []serializers.Metric) error {
+	u := url.URL{
+		Scheme: t.scheme,
+		Host:   cfg.Address,
+		Path:   "updates",
+	}
+
+	postBody, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	if t.publicKey != nil {
+		postBody, err = encryption.Encrypt(t.publicKey, postBody)
+		if err != nil {
+			return err
+		}
+	}
+
+	responseBody := bytes.NewBuffer(postBody)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), responseBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if t.publicKey != nil {
+		request.Header.Set(encryption.Header, encryption.Scheme)
+	}
+	if ip, err := outboundIP(cfg.Address); err == nil {
+		request.Header.Set("X-Real-IP", ip)
+	}
+	if cfg.AgentID != "" {
+		request.Header.Set("X-Agent-ID", cfg.AgentID)
+	}
+	if cfg.Key != "" {
+		request.Header.Set("HashSHA256", serializers.Sign(cfg.Key, postBody))
+		// подпись ответа считается по телу без распаковки, поэтому
+		// отказываемся от прозрачного gzip в http.Client
+		request.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// отправляем запрос
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	// печатаем код ответа
+	log.Debug().Msgf("Статус-код %v", response.Status)
+	defer response.Body.Close()
+
+	// читаем поток из тела ответа
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("Ошибка при чтении ответа")
+	}
+	// и печатаем его
+	log.Debug().Msg(string(body))
+
+	if signature := response.Header.Get("HashSHA256"); cfg.Key != "" && signature != "" && signature != serializers.Sign(cfg.Key, body) {
+		log.Error().Msg("Подпись ответа сервера не совпадает")
+	}
+
+	statusErr := &retry.StatusError{Code: response.StatusCode}
+	if response.StatusCode >= http.StatusInternalServerError || retryPolicy.Retryable(statusErr) {
+		return statusErr
+	}
+
+	return nil
+}
+
+func (t *httpTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// Отправка батча через gRPC-метод Updates по одному долгоживущему соединению
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	client pb.MetricsClient
+}
+
+// Одна попытка отправки батча. Повторяем только ошибки, связанные с доступностью сервера
+func (t *grpcTransport) Send(ctx context.Context, batch []serializers.Metric) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+
+	req := &pb.UpdatesRequest{Metrics: make([]*pb.Metric, 0, len(batch))}
+	for _, metric := range batch {
+		req.Metrics = append(req.Metrics, pb.ToProto(metric))
+	}
+
+	if ip, err := outboundIP(cfg.GRPCAddress); err == nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", ip)
+	}
+	if cfg.AgentID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-agent-id", cfg.AgentID)
+	}
+
+	_, err := t.client.Updates(ctx, req)
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Canceled:
+		return err
+	default:
+		log.Error().Err(err).Msg("Сервер отклонил батч")
+		return nil
+	}
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Адрес интерфейса, через который агент ходит на сервер. UDP-сокет
+// не отправляет пакетов, а только выбирает маршрут до адреса
+func outboundIP(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,32 +14,72 @@ import (
 
 	"github.com/caarlos0/env/v6"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/region23/go-musthave-devops/internal/encryption"
+	pb "github.com/region23/go-musthave-devops/internal/proto"
 	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/keys"
+	mw "github.com/region23/go-musthave-devops/internal/server/middleware"
 	"github.com/region23/go-musthave-devops/internal/server/storage"
 	"github.com/region23/go-musthave-devops/internal/server/storage/database"
+	"github.com/region23/go-musthave-devops/internal/tlsconfig"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var dbpool *pgxpool.Pool
 
 type Config struct {
-	Address       string        `env:"ADDRESS"`
-	StoreInterval time.Duration `env:"STORE_INTERVAL"`
-	StoreFile     string        `env:"STORE_FILE"`
-	Restore       bool          `env:"RESTORE"`
-	Key           string        `env:"KEY"`
-	DatabaseDSN   string        `env:"DATABASE_DSN"`
+	Address         string        `env:"ADDRESS"`
+	StoreInterval   time.Duration `env:"STORE_INTERVAL"`
+	StoreFile       string        `env:"STORE_FILE"`
+	StoreRetain     int           `env:"STORE_RETAIN"`
+	Restore         bool          `env:"RESTORE"`
+	Key             string        `env:"KEY"`
+	DatabaseDSN     string        `env:"DATABASE_DSN"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	GRPCAddress     string        `env:"GRPC_ADDRESS"`
+	CryptoKey       string        `env:"CRYPTO_KEY"`
+	TrustedSubnet   string        `env:"TRUSTED_SUBNET"`
+	TrustedRead     string        `env:"TRUSTED_SUBNET_READ"`
+	TrustedProxies  string        `env:"TRUSTED_PROXIES"`
+	TLSCert         string        `env:"TLS_CERT"`
+	TLSKey          string        `env:"TLS_KEY"`
+	TLSClientCA     string        `env:"TLS_CLIENT_CA"`
+	KeysFile        string        `env:"KEYS_FILE"`
+	DBTimeout       time.Duration `env:"DB_TIMEOUT"`
+	WALFile         string        `env:"WAL_FILE"`
+	WALSync         string        `env:"WAL_SYNC"`
+	WALSyncInterval time.Duration `env:"WAL_SYNC_INTERVAL"`
 }
 
 var cfg Config = Config{}
 
+// Интервал сохранения снэпшота по умолчанию
+const defaultStoreInterval = 300 * time.Second
+
 func init() {
 	flag.StringVar(&cfg.Address, "a", "127.0.0.1:8080", "server address")
 	flag.BoolVar(&cfg.Restore, "r", true, "restore metrics before start")
-	flag.DurationVar(&cfg.StoreInterval, "i", 300*time.Second, "store interval")
+	flag.DurationVar(&cfg.StoreInterval, "i", defaultStoreInterval, "store interval (0 writes every update to disk synchronously)")
 	flag.StringVar(&cfg.StoreFile, "f", "/tmp/devops-metrics-db.json", "path to file for metrics store")
+	flag.IntVar(&cfg.StoreRetain, "store-retain", 3, "number of snapshot files to keep, including the current one")
 	flag.StringVar(&cfg.Key, "k", "", "key for hashing")
 	flag.StringVar(&cfg.DatabaseDSN, "d", "", "database connection string")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
+	flag.StringVar(&cfg.GRPCAddress, "grpc-address", "", "gRPC server address (empty disables gRPC)")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "path to PEM file with private RSA key to decrypt agent requests")
+	flag.StringVar(&cfg.TrustedSubnet, "t", "", "comma separated CIDR subnets allowed to send metrics (empty allows all)")
+	flag.StringVar(&cfg.TrustedRead, "trusted-subnet-read", "", "comma separated CIDR subnets allowed to read metrics (empty allows all)")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "comma separated CIDR subnets of proxies allowed to pass the agent address in X-Real-IP")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "path to PEM server certificate (enables TLS)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "path to PEM server private key")
+	flag.StringVar(&cfg.TLSClientCA, "tls-client-ca", "", "path to PEM CA bundle to require and verify agent client certificates")
+	flag.DurationVar(&cfg.DBTimeout, "db-timeout", 5*time.Second, "timeout of a single storage request made by a handler (0 disables)")
+	flag.StringVar(&cfg.WALFile, "wal-file", "", "path to write-ahead log of accepted metrics in file mode (empty disables it, or uses <store file>.wal when the store interval is 0)")
+	flag.StringVar(&cfg.WALSync, "wal-sync", "interval", "write-ahead log fsync policy: always, interval or never")
+	flag.DurationVar(&cfg.WALSyncInterval, "wal-sync-interval", time.Second, "write-ahead log fsync interval for the interval policy")
+	flag.StringVar(&cfg.KeysFile, "keys-file", "", "path to JSON file with per-agent hashing keys (reloaded on SIGHUP)")
 }
 
 func main() {
@@ -46,56 +89,89 @@ func main() {
 		log.Error().Err(err).Msgf("%+v\n", err)
 	}
 
-	osSigChan := make(chan os.Signal, 1)
-	signal.Notify(osSigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "migrate" {
+			log.Fatal().Msgf("Неизвестная команда %q", flag.Arg(0))
+		}
+		if err := migrate(ctx, os.Stdout, cfg.DatabaseDSN, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("Не смогли выполнить миграцию")
+		}
+		return
+	}
 
 	var repository storage.Repository
+	// в режиме хранения в файле после остановки сервера сбрасываем метрики на диск
+	var memStorage *storage.InMemory
+	var producer *storage.Producer
+	// журнал принятых метрик, nil если журнал выключен
+	var journaled *storage.Journaled
 
 	if cfg.DatabaseDSN == "" {
-		repository = storage.NewInMemory()
+		memStorage = storage.NewInMemory()
+		repository = memStorage
 		consumer, err := storage.NewConsumer(cfg.StoreFile)
 		if err != nil {
 			log.Panic().Err(err).Msg("Не смогли инициализировать консумера")
 		}
 
-		if cfg.Restore {
-			metricsFromFile, err := consumer.ReadMetrics()
+		// синхронная запись идёт через журнал: пачка дописывается в него
+		// с fsync до ответа, а снэпшот только сжимает журнал
+		if cfg.StoreInterval <= 0 && cfg.WALFile == "" {
+			cfg.WALFile = cfg.StoreFile + ".wal"
+			log.Info().Msgf("STORE_INTERVAL=0: принятые метрики пишутся в журнал %s", cfg.WALFile)
+		}
+
+		// с журналом снэпшот читаем всегда: номер последней вошедшей в него
+		// записи журнала нужен для продолжения нумерации
+		if cfg.Restore || cfg.WALFile != "" {
+			readMetrics := consumer.ReadMetrics
+			if cfg.WALFile != "" {
+				readMetrics = consumer.ReadLatest
+			}
+			snapshot, err := readMetrics()
 			if err != nil {
 				log.Panic().Err(err).Msg("Не смогли прочитать метрики из консумера")
 			}
 
-			repository.UpdateAll(metricsFromFile)
-			if err != nil {
-				log.Panic().Err(err).Msg("Не смогли обновить батч метрик в хранилище")
+			if cfg.WALFile != "" {
+				journaled, err = openJournal(memStorage, snapshot)
+				if err != nil {
+					log.Panic().Err(err).Msg("Не смогли восстановить метрики из журнала")
+				}
+				repository = journaled
+			} else {
+				err = memStorage.Restore(snapshot)
+				if err != nil {
+					log.Panic().Err(err).Msg("Не смогли обновить батч метрик в хранилище")
+				}
 			}
 		}
+		consumer.Close()
 
-		producer, err := storage.NewProducer(cfg.StoreFile)
+		producer, err = storage.NewProducer(cfg.StoreFile, cfg.StoreRetain)
 		if err != nil {
 			log.Panic().Err(err).Msg("Не смогли инициализировать продюсера")
 		}
 
-		storeIntervalTick := time.NewTicker(cfg.StoreInterval)
+		// при STORE_INTERVAL=0 каждая пачка уже сброшена на диск в журнале
+		storeInterval := cfg.StoreInterval
+		if storeInterval <= 0 {
+			storeInterval = defaultStoreInterval
+		}
+		storeIntervalTick := time.NewTicker(storeInterval)
 		go func() {
 			for {
 				select {
 				case <-storeIntervalTick.C:
-					metrics, err := repository.All()
-
-					if err != nil {
-						log.Panic().Err(err).Msg("Не смогли прочитать метрики из хранилища")
-					}
-
-					producer.WriteMetrics(metrics)
-				case <-osSigChan:
-					metrics, err := repository.All()
-
-					if err != nil {
-						log.Panic().Err(err).Msg("Не смогли прочитать метрики из хранилища")
+					if err := storeSnapshot(memStorage, journaled, producer); err != nil {
+						log.Error().Err(err).Msg("Не смогли сохранить метрики в файл")
 					}
-
-					producer.WriteMetrics(metrics)
-					os.Exit(0)
+				case <-ctx.Done():
+					storeIntervalTick.Stop()
+					return
 				}
 			}
 		}()
@@ -112,13 +188,6 @@ func main() {
 			log.Fatal().Err(err).Msg("Не смогли подключиться к базе данных")
 		}
 
-		defer dbpool.Close()
-
-		go func() {
-			<-osSigChan
-			os.Exit(0)
-		}()
-
 		repository = database.NewInDatabase(dbpool, cfg.Key)
 
 	}
@@ -126,7 +195,193 @@ func main() {
 	log.Debug().Msg("Starting server...")
 
 	srv := server.New(repository, cfg.Key, dbpool)
+	srv.StorageTimeout = cfg.DBTimeout
+
+	var err error
+	if cfg.CryptoKey != "" {
+		srv.PrivateKey, err = encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли прочитать закрытый ключ")
+		}
+	}
+
+	srv.TrustedSubnets, err = mw.ParseSubnets(cfg.TrustedSubnet)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли разобрать доверенные подсети")
+	}
+
+	srv.TrustedReadSubnets, err = mw.ParseSubnets(cfg.TrustedRead)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли разобрать доверенные подсети для чтения")
+	}
+
+	srv.TrustedProxies, err = mw.ParseSubnets(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Не смогли разобрать адреса доверенных прокси")
+	}
+
+	if cfg.KeysFile != "" {
+		srv.Keys, err = keys.Load(cfg.KeysFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли прочитать файл ключей агентов")
+		}
+		go reloadKeys(ctx, srv.Keys)
+	}
+
 	srv.MountHandlers()
 
-	http.ListenAndServe(cfg.Address, srv.Router)
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		tlsConfig, err = tlsconfig.Server(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли загрузить TLS-сертификат сервера")
+		}
+	} else if cfg.TLSClientCA != "" {
+		log.Fatal().Msg("Проверка клиентских сертификатов требует TLS-сертификата сервера")
+	}
+
+	httpServer := &http.Server{
+		Addr:      cfg.Address,
+		Handler:   srv.Router,
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			// сертификат уже загружен в TLSConfig
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("Не смогли запустить сервер")
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		listen, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Не смогли запустить gRPC-сервер")
+		}
+
+		grpcMetrics := server.NewGRPCServer(srv)
+		opts := []grpc.ServerOption{
+			grpc.UnaryInterceptor(grpcMetrics.UnaryInterceptor),
+			grpc.StreamInterceptor(grpcMetrics.StreamInterceptor),
+		}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = grpc.NewServer(opts...)
+		pb.RegisterMetricsServer(grpcServer, grpcMetrics)
+
+		go func() {
+			if err := grpcServer.Serve(listen); err != nil {
+				log.Fatal().Err(err).Msg("Не смогли запустить gRPC-сервер")
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	log.Info().Msg("Останавливаем сервер...")
+
+	// перестаём принимать новые соединения и ждём завершения текущих запросов
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("Не дождались завершения запросов")
+	}
+
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-shutdownCtx.Done():
+			log.Error().Msg("Не дождались завершения gRPC-запросов")
+			grpcServer.Stop()
+		}
+	}
+
+	if producer != nil {
+		if err := storeSnapshot(memStorage, journaled, producer); err != nil {
+			log.Error().Err(err).Msg("Не смогли сохранить метрики в файл")
+		}
+		producer.Close()
+	}
+
+	if journaled != nil {
+		if err := journaled.Close(); err != nil {
+			log.Error().Err(err).Msg("Не смогли закрыть журнал")
+		}
+	}
+
+	if dbpool != nil {
+		dbpool.Close()
+	}
+}
+
+// Перечитываем файл ключей агентов по SIGHUP, чтобы менять ключи без перезапуска
+func reloadKeys(ctx context.Context, registry *keys.Registry) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := registry.Reload(); err != nil {
+				log.Error().Err(err).Msg("Не смогли перечитать файл ключей агентов, оставляем прежние ключи")
+				continue
+			}
+			log.Info().Msg("Файл ключей агентов перечитан")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Открываем журнал и восстанавливаем память из снэпшота и хвоста журнала
+func openJournal(memStorage *storage.InMemory, snapshot storage.Snapshot) (*storage.Journaled, error) {
+	policy, err := storage.ParseWALSync(cfg.WALSync)
+	if err != nil {
+		return nil, err
+	}
+	// синхронная запись - fsync журнала на каждую пачку
+	if cfg.StoreInterval <= 0 && policy != storage.WALSyncAlways {
+		log.Info().Msgf("STORE_INTERVAL=0: журнал сбрасывается на диск после каждой пачки вместо политики %s", policy)
+		policy = storage.WALSyncAlways
+	}
+
+	wal, records, err := storage.OpenWAL(cfg.WALFile, policy, cfg.WALSyncInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	journaled := storage.NewJournaled(memStorage, wal)
+	replayed, err := journaled.Recover(snapshot, records, cfg.Restore)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	log.Info().Msgf("Из журнала восстановлено пачек метрик: %d", replayed)
+
+	return journaled, nil
+}
+
+// Сохраняем снэпшот в файл. С журналом это его сжатие: журнал очищается
+func storeSnapshot(memStorage *storage.InMemory, journaled *storage.Journaled, producer *storage.Producer) error {
+	if journaled != nil {
+		return journaled.Compact(producer)
+	}
+	return producer.WriteMetrics(memStorage.Snapshot())
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchAtomic(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		wantStatusCode int
+		wantErrors     []server.ItemError
+		wantCounter    int64
+	}{
+		{
+			name:           "valid_batch",
+			body:           `[{"id":"batchCounter","type":"counter","delta":2},{"id":"batchCounter","type":"counter","delta":3},{"id":"batchGauge","type":"gauge","value":1.5}]`,
+			wantStatusCode: http.StatusOK,
+			wantCounter:    5,
+		},
+		{
+			name:           "invalid_items_reject_whole_batch",
+			body:           `[{"id":"batchCounter","type":"counter","delta":10},{"id":"","type":"gauge","value":1},{"id":"batchCounter","type":"counter","value":1}]`,
+			wantStatusCode: http.StatusNotFound,
+			wantErrors: []server.ItemError{
+				{Index: 1, Error: server.ErrEmptyID.Error()},
+				{Index: 2, ID: "batchCounter", Error: server.ErrEmptyValue.Error()},
+			},
+			wantCounter: 5,
+		},
+		{
+			name:           "invalid_hash_rejects_whole_batch",
+			body:           `[{"id":"batchCounter","type":"counter","delta":10},{"id":"batchGauge","type":"gauge","value":2,"hash":"bad"}]`,
+			wantStatusCode: http.StatusBadRequest,
+			wantErrors: []server.ItemError{
+				{Index: 1, ID: "batchGauge", Error: server.ErrInvalidHash.Error()},
+			},
+			wantCounter: 5,
+		},
+		{
+			name:           "next_valid_batch",
+			body:           `[{"id":"batchCounter","type":"counter","delta":1}]`,
+			wantStatusCode: http.StatusOK,
+			wantCounter:    6,
+		},
+	}
+
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBufferString(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			response := executeRequest(request, srv)
+
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+
+			var uResp server.UserResponse
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&uResp))
+			require.Equal(t, tt.wantErrors, uResp.Errors)
+
+			metric, err := repository.Get(context.Background(), "batchCounter")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCounter, *metric.Delta)
+		})
+	}
+
+	// повторы в пачке складываются в одну запись истории, как в базе
+	samples, err := repository.History(context.Background(), "batchCounter", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	require.Equal(t, int64(5), *samples[0].Delta)
+}
+
+func TestInMemoryPutBatchValidation(t *testing.T) {
+	repository := storage.NewInMemory()
+
+	delta := int64(1)
+	err := repository.PutBatch(context.Background(), []serializers.Metric{
+		{ID: "first", MType: "counter", Delta: &delta},
+		{ID: "second", MType: "gauge"},
+	})
+	require.ErrorIs(t, err, storage.ErrInvalidMetric)
+
+	_, err = repository.Get(context.Background(), "first")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestBatchTypeConflict(t *testing.T) {
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBufferString(`[{"id":"conflict","type":"gauge","value":1.5}]`))
+	checkResponseCode(t, http.StatusOK, executeRequest(request, srv).Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBufferString(`[{"id":"conflict","type":"counter","delta":1}]`))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(request, srv).Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/update/counter/conflict/1", nil)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(request, srv).Code)
+
+	metric, err := repository.Get(context.Background(), "conflict")
+	require.NoError(t, err)
+	require.Equal(t, "gauge", metric.MType)
+	require.Equal(t, 1.5, *metric.Value)
+
+	// конфликт внутри одной пачки
+	delta, value := int64(1), 2.0
+	err = repository.PutBatch(context.Background(), []serializers.Metric{
+		{ID: "mixed", MType: "gauge", Value: &value},
+		{ID: "mixed", MType: "counter", Delta: &delta},
+	})
+	require.ErrorIs(t, err, storage.ErrTypeConflict)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/region23/go-musthave-devops/internal/proto"
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+)
+
+// newGRPCClient поднимает gRPC-сервер поверх in-memory соединения
+func newGRPCClient(t *testing.T, srv *server.Server) pb.MetricsClient {
+	listen := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	pb.RegisterMetricsServer(grpcServer, server.NewGRPCServer(srv))
+	go grpcServer.Serve(listen)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listen.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+func TestGRPCUpdates(t *testing.T) {
+	m1 := NewMetric("testCounter", "counter", "100")
+	m2 := NewMetric("testGauge", "gauge", "1.5")
+	m3 := NewMetric("testGauge", "unknown", "1.5")
+	m4 := NewMetric("testGauge", "gauge", "none")
+	m5 := NewMetric("testGauge", "gauge", "1.5")
+	m5.Hash = "invalid"
+
+	tests := []struct {
+		name     string
+		metrics  []serializers.Metric
+		wantCode codes.Code
+	}{
+		{
+			name:     "update",
+			metrics:  []serializers.Metric{m1, m2},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "empty_batch",
+			metrics:  []serializers.Metric{},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid_type",
+			metrics:  []serializers.Metric{m3},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name:     "invalid_value",
+			metrics:  []serializers.Metric{m4},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid_hash",
+			metrics:  []serializers.Metric{m5},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	client := newGRPCClient(t, srv)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &pb.UpdatesRequest{}
+			for _, metric := range tt.metrics {
+				req.Metrics = append(req.Metrics, pb.ToProto(metric))
+			}
+
+			_, err := client.Updates(context.Background(), req)
+			require.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+
+	metric, err := repository.Get(context.Background(), "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), *metric.Delta)
+}
+
+func TestGRPCStream(t *testing.T) {
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	client := newGRPCClient(t, srv)
+
+	stream, err := client.Stream(context.Background())
+	require.NoError(t, err)
+
+	for _, value := range []string{"1", "2", "3"} {
+		metric := NewMetric("testCounter", "counter", value)
+		err := stream.Send(&pb.UpdatesRequest{Metrics: []*pb.Metric{pb.ToProto(metric)}})
+		require.NoError(t, err)
+	}
+
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	metric, err := repository.Get(context.Background(), "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, int64(6), *metric.Delta)
+}
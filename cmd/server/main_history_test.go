@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	for _, value := range []string{"1", "2", "3"} {
+		request := httptest.NewRequest(http.MethodPost, "/update/counter/testHistory/"+value, nil)
+		response := executeRequest(request, srv)
+		checkResponseCode(t, http.StatusOK, response.Code)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name           string
+		endpointURL    string
+		wantStatusCode int
+		wantDeltas     []int64
+	}{
+		{
+			name:           "all",
+			endpointURL:    "/history/counter/testHistory",
+			wantStatusCode: http.StatusOK,
+			wantDeltas:     []int64{1, 3, 6},
+		},
+		{
+			name:           "empty_range",
+			endpointURL:    "/history/counter/testHistory?from=" + future,
+			wantStatusCode: http.StatusOK,
+			wantDeltas:     []int64{},
+		},
+		{
+			name:           "invalid_from",
+			endpointURL:    "/history/counter/testHistory?from=yesterday",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "wrong_type",
+			endpointURL:    "/history/gauge/testHistory",
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "unknown",
+			endpointURL:    "/history/counter/testUnknown",
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.endpointURL, nil)
+			response := executeRequest(request, srv)
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+
+			if tt.wantDeltas == nil {
+				return
+			}
+
+			var samples []storage.Sample
+			err := json.NewDecoder(response.Body).Decode(&samples)
+			require.NoError(t, err)
+
+			deltas := []int64{}
+			for _, sample := range samples {
+				deltas = append(deltas, *sample.Delta)
+			}
+			require.Equal(t, tt.wantDeltas, deltas)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/keys"
+	"github.com/region23/go-musthave-devops/internal/server/middleware"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"web-1": [
+			{"key": "web-1-new"},
+			{"key": "web-1-old", "expires_at": "2100-01-01T00:00:00Z"},
+			{"key": "web-1-expired", "expires_at": "2000-01-01T00:00:00Z"}
+		],
+		"web-2": [{"key": "web-2-expired", "expires_at": "2000-01-01T00:00:00Z"}]
+	}`), 0600))
+
+	registry, err := keys.Load(path)
+	require.NoError(t, err)
+
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.Keys = registry
+	srv.MountHandlers()
+
+	tests := []struct {
+		name           string
+		agentID        string
+		signKey        string
+		wantStatusCode int
+	}{
+		{
+			name:           "current_key",
+			agentID:        "web-1",
+			signKey:        "web-1-new",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "rotated_key_in_window",
+			agentID:        "web-1",
+			signKey:        "web-1-old",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "expired_key",
+			agentID:        "web-1",
+			signKey:        "web-1-expired",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "other_agent_key",
+			agentID:        "web-1",
+			signKey:        key,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "all_keys_expired",
+			agentID:        "web-2",
+			signKey:        "web-2-expired",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "unsigned_from_known_agent",
+			agentID:        "web-1",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown_agent_with_server_key",
+			agentID:        "web-3",
+			signKey:        key,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "unknown_agent_with_bad_hash",
+			agentID:        "random-agent",
+			signKey:        "guess",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "without_agent_id",
+			signKey:        key,
+			wantStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := serializers.InitMetrics(tt.signKey, nil)
+			metrics.Add("testCounter", "counter", int64(1))
+
+			postBody, err := json.Marshal(metrics.GetAll())
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBuffer(postBody))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.agentID != "" {
+				request.Header.Set(middleware.AgentIDHeader, tt.agentID)
+			}
+			response := executeRequest(request, srv)
+
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+		})
+	}
+
+	// неизвестные агенты не получают отдельных счётчиков
+	require.Equal(t, map[string]uint64{"web-1": 3, "web-2": 1, keys.UnknownAgent: 1}, registry.Rejections())
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	response := executeRequest(request, srv)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	require.Contains(t, response.Body.String(), `server_hash_rejections_total{agent="web-1"} 3`)
+
+	// после ротации и SIGHUP старый ключ перестаёт приниматься
+	require.NoError(t, os.WriteFile(path, []byte(`{"web-1": [{"key": "web-1-next"}]}`), 0600))
+	require.NoError(t, registry.Reload())
+
+	for signKey, wantStatusCode := range map[string]int{"web-1-new": http.StatusBadRequest, "web-1-next": http.StatusOK} {
+		metrics := serializers.InitMetrics(signKey, nil)
+		metrics.Add("testGauge", "gauge", 1.5)
+
+		postBody, err := json.Marshal(metrics.GetAll())
+		require.NoError(t, err)
+
+		request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBuffer(postBody))
+		request.Header.Set(middleware.AgentIDHeader, "web-1")
+		response := executeRequest(request, srv)
+		require.Equal(t, wantStatusCode, response.Code, fmt.Sprintf("ключ %s", signKey))
+	}
+
+	// метрика, подписанная ключом агента, читается с подписью ключом сервера
+	request = httptest.NewRequest(http.MethodPost, "/value", bytes.NewBufferString(`{"id":"testGauge","type":"gauge"}`))
+	request.Header.Set(middleware.AgentIDHeader, "web-1")
+	response = executeRequest(request, srv)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var metric serializers.Metric
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&metric))
+	require.Equal(t, 1.5, *metric.Value)
+	require.Equal(t, serializers.Hash(key, "testGauge", "gauge", fmt.Sprintf("%f", 1.5), nil), metric.Hash)
+}
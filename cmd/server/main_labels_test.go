@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsJSON(t *testing.T) {
+	web1 := serializers.InitMetrics(key, map[string]string{"host": "web1", "env": "prod"})
+	web2 := serializers.InitMetrics(key, map[string]string{"host": "web2", "env": "prod"})
+	require.NoError(t, web1.Add("Alloc", "gauge", 1.5))
+	require.NoError(t, web2.Add("Alloc", "gauge", 2.5))
+
+	m1, _ := web1.Get("Alloc")
+	m2, _ := web2.Get("Alloc")
+	forged := m2
+	forged.Labels = map[string]string{"host": "web1", "env": "prod"}
+
+	tests := []struct {
+		name           string
+		metric         serializers.Metric
+		wantStatusCode int
+	}{
+		{
+			name:           "update_web1",
+			metric:         m1,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "update_web2",
+			metric:         m2,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "labels_not_covered_by_hash",
+			metric:         forged,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postBody, err := json.Marshal(tt.metric)
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBuffer(postBody))
+			request.Header.Set("Content-Type", "application/json")
+			response := executeRequest(request, srv)
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+		})
+	}
+
+	for _, want := range []serializers.Metric{m1, m2} {
+		postBody, err := json.Marshal(serializers.Metric{ID: want.ID, MType: want.MType, Labels: want.Labels})
+		require.NoError(t, err)
+
+		request := httptest.NewRequest(http.MethodPost, "/value", bytes.NewBuffer(postBody))
+		request.Header.Set("Content-Type", "application/json")
+		response := executeRequest(request, srv)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var got serializers.Metric
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&got))
+		require.Equal(t, *want.Value, *got.Value)
+		require.Equal(t, want.Labels, got.Labels)
+	}
+
+	// метки серии в текстовых ручках передаются параметром labels
+	for _, want := range []serializers.Metric{m1, m2} {
+		query := url.Values{"labels": {"host=" + want.Labels["host"] + ",env=prod"}}.Encode()
+
+		request := httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc?"+query, nil)
+		response := executeRequest(request, srv)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		require.Equal(t, fmt.Sprintf("%g", *want.Value), response.Body.String())
+
+		request = httptest.NewRequest(http.MethodGet, "/history/gauge/Alloc?"+query, nil)
+		response = executeRequest(request, srv)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var samples []storage.Sample
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&samples))
+		require.Len(t, samples, 1)
+		require.Equal(t, *want.Value, *samples[0].Value)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc?labels=host", nil)
+	response := executeRequest(request, srv)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	response = executeRequest(request, srv)
+	require.Contains(t, response.Body.String(), "# TYPE Alloc gauge\n"+
+		"Alloc{env=\"prod\",host=\"web1\"} 1.5\n"+
+		"Alloc{env=\"prod\",host=\"web2\"} 2.5\n")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	for _, endpointURL := range []string{
+		"/update/gauge/CPUutilization1/12.5",
+		"/update/counter/PollCount/3",
+		"/update/gauge/2xx.rate/0.25",
+	} {
+		request := httptest.NewRequest(http.MethodPost, endpointURL, nil)
+		response := executeRequest(request, srv)
+		checkResponseCode(t, http.StatusOK, response.Code)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	response := executeRequest(request, srv)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	want := "# HELP CPUutilization1 CPUutilization1 gauge metric.\n" +
+		"# TYPE CPUutilization1 gauge\n" +
+		"CPUutilization1 12.5\n" +
+		"# HELP PollCount PollCount counter metric.\n" +
+		"# TYPE PollCount counter\n" +
+		"PollCount 3\n" +
+		"# HELP _2xx_rate 2xx.rate gauge metric.\n" +
+		"# TYPE _2xx_rate gauge\n" +
+		"_2xx_rate 0.25\n"
+	require.Equal(t, want, response.Body.String())
+	require.Contains(t, response.Header().Get("Content-Type"), "version=0.0.4")
+}
+
+// Сбор метрик идёт параллельно с записями, запускается с -race
+func TestPrometheusMetricsConcurrentUpdates(t *testing.T) {
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/update/gauge/Gauge%d/%d", i, i), nil)
+			checkResponseCode(t, http.StatusOK, executeRequest(request, srv).Code)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		checkResponseCode(t, http.StatusOK, executeRequest(request, srv).Code)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/middleware"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSignature(t *testing.T) {
+	// старый хэш метрики не совпадает с ключом, но при подписи тела он не проверяется
+	body := []byte(`[{"id":"signedGauge","type":"gauge","value":0.1234567891,"hash":"stale"}]`)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+
+	tests := []struct {
+		name           string
+		body           []byte
+		gzip           bool
+		signature      string
+		wantStatusCode int
+	}{
+		{
+			name:           "valid_signature",
+			body:           body,
+			signature:      serializers.Sign(key, body),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "signature_over_compressed_body",
+			body:           compressed.Bytes(),
+			gzip:           true,
+			signature:      serializers.Sign(key, compressed.Bytes()),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "wrong_key",
+			body:           body,
+			signature:      serializers.Sign("other", body),
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "not_hex",
+			body:           body,
+			signature:      "zz",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "legacy_metric_hash",
+			body:           body,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				request.Header.Set("Content-Encoding", "gzip")
+			}
+			if tt.signature != "" {
+				request.Header.Set(middleware.SignatureHeader, tt.signature)
+			}
+			response := executeRequest(request, srv)
+
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+		})
+	}
+
+	metric, err := repository.Get(context.Background(), "signedGauge")
+	require.NoError(t, err)
+	require.Equal(t, 0.1234567891, *metric.Value)
+	// непроверенный хэш из подписанного тела не сохраняется
+	require.Empty(t, metric.Hash)
+}
+
+func TestRequestSignatureLimits(t *testing.T) {
+	srv := server.New(storage.NewInMemory(), key, nil)
+	subnets, err := middleware.ParseSubnets("10.0.0.0/24")
+	require.NoError(t, err)
+	srv.TrustedSubnets = subnets
+	srv.MountHandlers()
+
+	// подпись запроса из чужой подсети не проверяется, тело не читается
+	body := []byte(`[{"id":"signedGauge","type":"gauge","value":1}]`)
+	request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+	request.Header.Set(middleware.SignatureHeader, serializers.Sign(key, body))
+	request.RemoteAddr = "192.168.1.9:5555"
+	checkResponseCode(t, http.StatusForbidden, executeRequest(request, srv).Code)
+
+	// слишком большое подписанное тело отклоняется до подсчёта подписи
+	body = make([]byte, middleware.MaxSignedBody+1)
+	request = httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+	request.Header.Set(middleware.SignatureHeader, serializers.Sign(key, body))
+	request.RemoteAddr = "10.0.0.5:5555"
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, executeRequest(request, srv).Code)
+}
+
+func TestResponseSignature(t *testing.T) {
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	srv.MountHandlers()
+
+	request := httptest.NewRequest(http.MethodPost, "/update/counter/testCounter/5", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response := executeRequest(request, srv)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	require.Equal(t, "gzip", response.Header().Get("Content-Encoding"))
+	require.Equal(t, serializers.Sign(key, response.Body.Bytes()), response.Header().Get(middleware.SignatureHeader))
+
+	// подписываются только ответы на приём метрик, страницы чтения не копятся в памяти
+	request = httptest.NewRequest(http.MethodGet, "/value/counter/testCounter", nil)
+	response = executeRequest(request, srv)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	require.Empty(t, response.Header().Get(middleware.SignatureHeader))
+
+	// без ключа сервер ответы не подписывает
+	srv = server.New(storage.NewInMemory(), "", nil)
+	srv.MountHandlers()
+
+	request = httptest.NewRequest(http.MethodGet, "/ping", nil)
+	response = executeRequest(request, srv)
+	require.Empty(t, response.Header().Get(middleware.SignatureHeader))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/middleware"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		endpointURL    string
+		realIP         string
+		remoteAddr     string
+		wantStatusCode int
+	}{
+		{
+			name:           "update_from_trusted_header",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			realIP:         "10.0.0.5",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "update_from_untrusted_header",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			realIP:         "192.168.1.5",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "update_from_trusted_remote_addr",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			remoteAddr:     "10.0.0.7:5555",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "spoofed_header_from_untrusted_peer",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			realIP:         "10.0.0.5",
+			remoteAddr:     "192.168.1.9:5555",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "header_ignored_from_trusted_peer",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			realIP:         "192.168.1.5",
+			remoteAddr:     "10.0.0.7:5555",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "update_from_untrusted_remote_addr",
+			method:         http.MethodPost,
+			endpointURL:    "/update/counter/testCounter/1",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "batch_from_untrusted_header",
+			method:         http.MethodPost,
+			endpointURL:    "/updates",
+			realIP:         "192.168.1.5",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "read_is_open",
+			method:         http.MethodGet,
+			endpointURL:    "/value/counter/testCounter",
+			realIP:         "192.168.1.5",
+			wantStatusCode: http.StatusOK,
+		},
+	}
+
+	// Create a New Server Struct
+	repository := storage.NewInMemory()
+	srv := server.New(repository, key, nil)
+	subnets, err := middleware.ParseSubnets("10.0.0.0/24, 172.16.0.0/12")
+	require.NoError(t, err)
+	srv.TrustedSubnets = subnets
+	// запросы без remoteAddr приходят с адреса httptest 192.0.2.1 - это доверенный прокси
+	srv.TrustedProxies, err = middleware.ParseSubnets("192.0.2.1/32")
+	require.NoError(t, err)
+	srv.MountHandlers()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.endpointURL, nil)
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.remoteAddr != "" {
+				request.RemoteAddr = tt.remoteAddr
+			}
+			// Execute Request
+			response := executeRequest(request, srv)
+
+			// Check the response code
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+		})
+	}
+}
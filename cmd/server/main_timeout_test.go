@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// Хранилище, которое не отвечает, пока не истечёт контекст запроса
+type stuckRepository struct {
+	*storage.InMemory
+}
+
+func (r stuckRepository) Get(ctx context.Context, key string) (*serializers.Metric, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r stuckRepository) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Хранилище без соединения с базой
+type unavailableRepository struct {
+	*storage.InMemory
+}
+
+func (r unavailableRepository) All(ctx context.Context) (map[string]serializers.Metric, error) {
+	return nil, storage.ErrUnavailable
+}
+
+// Хранилище, которое не может записать метрики
+type failingRepository struct {
+	*storage.InMemory
+}
+
+func (r failingRepository) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	return errors.New("disk full")
+}
+
+func TestStorageTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		repository     storage.Repository
+		method         string
+		endpointURL    string
+		body           string
+		wantStatusCode int
+	}{
+		{
+			name:           "get_timeout",
+			repository:     stuckRepository{storage.NewInMemory()},
+			method:         http.MethodGet,
+			endpointURL:    "/value/counter/testCounter",
+			wantStatusCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "batch_timeout",
+			repository:     stuckRepository{storage.NewInMemory()},
+			method:         http.MethodPost,
+			endpointURL:    "/updates",
+			body:           `[{"id":"testCounter","type":"counter","delta":1}]`,
+			wantStatusCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "unavailable",
+			repository:     unavailableRepository{storage.NewInMemory()},
+			method:         http.MethodGet,
+			endpointURL:    "/metrics",
+			wantStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "write_failed",
+			repository:     failingRepository{storage.NewInMemory()},
+			method:         http.MethodPost,
+			endpointURL:    "/updates",
+			body:           `[{"id":"testCounter","type":"counter","delta":1}]`,
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := server.New(tt.repository, key, nil)
+			srv.StorageTimeout = 10 * time.Millisecond
+			srv.MountHandlers()
+
+			request := httptest.NewRequest(tt.method, tt.endpointURL, bytes.NewBufferString(tt.body))
+			response := executeRequest(request, srv)
+
+			checkResponseCode(t, tt.wantStatusCode, response.Code)
+		})
+	}
+}
+
+func TestStorageClientDisconnect(t *testing.T) {
+	srv := server.New(stuckRepository{storage.NewInMemory()}, key, nil)
+	srv.MountHandlers()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest(http.MethodGet, "/value/counter/testCounter", nil).WithContext(ctx)
+
+	done := make(chan int)
+	go func() {
+		done <- executeRequest(request, srv).Code
+	}()
+
+	// без таймаута обработчик освобождается, когда клиент уходит
+	cancel()
+	select {
+	case code := <-done:
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	case <-time.After(time.Second):
+		t.Fatal("обработчик не завершился после отмены запроса")
+	}
+}
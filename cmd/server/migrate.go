@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/region23/go-musthave-devops/internal/server/storage/database"
+)
+
+// Подкоманда migrate up|down|status для управления схемой базы данных
+func migrate(ctx context.Context, w io.Writer, dsn string, args []string) error {
+	if dsn == "" {
+		return errors.New("не задана строка подключения к базе данных (-d или DATABASE_DSN)")
+	}
+	if len(args) != 1 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New("использование: server [флаги] migrate up|down|status")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	pool, err := pgxpool.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(ctx, pool)
+		for _, migration := range applied {
+			fmt.Fprintf(w, "applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "schema is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := database.MigrateDown(ctx, pool)
+		if reverted != nil {
+			fmt.Fprintf(w, "reverted %04d_%s\n", reverted.Version, reverted.Name)
+		}
+		if err == nil && reverted == nil {
+			fmt.Fprintln(w, "no migrations to revert")
+		}
+		return err
+	case "status":
+		states, err := database.MigrationStatus(ctx, pool)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.AppliedAt != nil {
+				status = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d_%s\t%s\n", state.Version, state.Name, status)
+		}
+	}
+
+	return nil
+}
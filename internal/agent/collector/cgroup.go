@@ -0,0 +1,391 @@
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+)
+
+// В cgroup v1 «без ограничения» записывается как огромное число, кратное размеру страницы
+const cgroupV1Unlimited = uint64(1) << 62
+
+// Cgroup собирает потребление ресурсов cgroup v1 или v2: процессор и его
+// троттлинг, память и её лимит, OOM, ввод-вывод и число процессов.
+// Внутри контейнера mem.VirtualMemory показывает память хоста, а лимит
+// контейнера видно только здесь. Накопительные значения отправляются счётчиками
+type Cgroup struct {
+	// точка монтирования cgroup, обычно /sys/fs/cgroup
+	root string
+	// пути cgroup относительно root. Пустой список - собственная cgroup агента
+	paths []string
+	// файл, по которому определяется собственная cgroup
+	selfCgroup string
+
+	counters *counters
+}
+
+func NewCgroup(root string, paths []string) *Cgroup {
+	return &Cgroup{
+		root:       root,
+		paths:      paths,
+		selfCgroup: "/proc/self/cgroup",
+		counters:   newCounters(),
+	}
+}
+
+func (c *Cgroup) Name() string {
+	return "cgroup"
+}
+
+func (c *Cgroup) Interval() time.Duration {
+	return 0
+}
+
+func (c *Cgroup) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	// без cgroup, например не в Linux, собственную cgroup собрать нельзя,
+	// и это не ошибка сбора. Явно заданные пути по-прежнему проверяются
+	if len(c.paths) == 0 && (!fileExists(c.root) || !fileExists(c.selfCgroup)) {
+		return nil
+	}
+
+	// в cgroup v2 одна иерархия, в её корне есть cgroup.controllers
+	_, err := os.Stat(filepath.Join(c.root, "cgroup.controllers"))
+	v2 := err == nil
+
+	own, err := parseSelfCgroup(c.selfCgroup)
+	if err != nil && len(c.paths) == 0 {
+		return err
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if len(c.paths) == 0 {
+		if v2 {
+			path := cleanCgroupPath(own[""])
+			fail(c.collectV2(metrics, path, c.ownV2Dir(path)))
+		} else {
+			fail(c.collectV1(metrics, cleanCgroupPath(own["memory"]), c.ownV1Dir(own)))
+		}
+		return firstErr
+	}
+
+	for _, path := range c.paths {
+		path := cleanCgroupPath(path)
+		if v2 {
+			fail(c.collectV2(metrics, path, filepath.Join(c.root, path)))
+			continue
+		}
+
+		if dir := filepath.Join(c.root, "memory", path); !fileExists(dir) {
+			fail(fmt.Errorf("cgroup %s: каталог %s не найден", path, dir))
+			continue
+		}
+		fail(c.collectV1(metrics, path, func(controller string) string {
+			return filepath.Join(c.root, controller, path)
+		}))
+	}
+
+	return firstErr
+}
+
+// collectV2 собирает cgroup path из каталога dir
+func (c *Cgroup) collectV2(metrics *serializers.Metrics, path, dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("cgroup %s: %w", path, err)
+	}
+	labels := map[string]string{"cgroup": path}
+
+	cpu, err := readKeyValues(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return err
+	}
+	c.inc(metrics, "CgroupCPUUsageUsec", path, cpu, "usage_usec", labels)
+	c.inc(metrics, "CgroupCPUPeriods", path, cpu, "nr_periods", labels)
+	c.inc(metrics, "CgroupCPUThrottledPeriods", path, cpu, "nr_throttled", labels)
+	c.inc(metrics, "CgroupCPUThrottledUsec", path, cpu, "throttled_usec", labels)
+
+	if usage, ok, err := readUint(filepath.Join(dir, "memory.current")); err != nil {
+		return err
+	} else if ok {
+		metrics.AddLabeled("CgroupMemoryUsage", "gauge", usage, labels)
+	}
+	if limit, ok, err := readUint(filepath.Join(dir, "memory.max")); err != nil {
+		return err
+	} else if ok {
+		metrics.AddLabeled("CgroupMemoryLimit", "gauge", limit, labels)
+	}
+
+	events, err := readKeyValues(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return err
+	}
+	c.inc(metrics, "CgroupOOMEvents", path, events, "oom", labels)
+	c.inc(metrics, "CgroupOOMKills", path, events, "oom_kill", labels)
+
+	if err := c.ioStatV2(metrics, path, filepath.Join(dir, "io.stat")); err != nil {
+		return err
+	}
+
+	return c.pids(metrics, dir, labels)
+}
+
+// collectV1 собирает cgroup path, dir возвращает её каталог в иерархии контроллера
+func (c *Cgroup) collectV1(metrics *serializers.Metrics, path string, dir func(controller string) string) error {
+	labels := map[string]string{"cgroup": path}
+
+	if usage, ok, err := readUint(filepath.Join(dir("cpuacct"), "cpuacct.usage")); err != nil {
+		return err
+	} else if ok {
+		c.incValue(metrics, "CgroupCPUUsageUsec", path, "", usage/1000, labels)
+	}
+
+	cpu, err := readKeyValues(filepath.Join(dir("cpu"), "cpu.stat"))
+	if err != nil {
+		return err
+	}
+	if throttled, ok := cpu["throttled_time"]; ok {
+		cpu["throttled_usec"] = throttled / 1000
+	}
+	c.inc(metrics, "CgroupCPUPeriods", path, cpu, "nr_periods", labels)
+	c.inc(metrics, "CgroupCPUThrottledPeriods", path, cpu, "nr_throttled", labels)
+	c.inc(metrics, "CgroupCPUThrottledUsec", path, cpu, "throttled_usec", labels)
+
+	if usage, ok, err := readUint(filepath.Join(dir("memory"), "memory.usage_in_bytes")); err != nil {
+		return err
+	} else if ok {
+		metrics.AddLabeled("CgroupMemoryUsage", "gauge", usage, labels)
+	}
+	if limit, ok, err := readUint(filepath.Join(dir("memory"), "memory.limit_in_bytes")); err != nil {
+		return err
+	} else if ok && limit < cgroupV1Unlimited {
+		metrics.AddLabeled("CgroupMemoryLimit", "gauge", limit, labels)
+	}
+
+	// oom_kill есть в memory.oom_control с ядра 4.13, отдельного счётчика OOM в v1 нет
+	oom, err := readKeyValues(filepath.Join(dir("memory"), "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	c.inc(metrics, "CgroupOOMKills", path, oom, "oom_kill", labels)
+
+	if err := c.ioStatV1(metrics, path, filepath.Join(dir("blkio"), "blkio.throttle.io_service_bytes"), "CgroupIOReadBytes", "CgroupIOWriteBytes"); err != nil {
+		return err
+	}
+	if err := c.ioStatV1(metrics, path, filepath.Join(dir("blkio"), "blkio.throttle.io_serviced"), "CgroupIOReads", "CgroupIOWrites"); err != nil {
+		return err
+	}
+
+	return c.pids(metrics, dir("pids"), labels)
+}
+
+// ownV2Dir возвращает каталог собственной cgroup. Если в контейнере в root
+// смонтирована только его cgroup, пути из /proc/self/cgroup под ним нет -
+// тогда берём сам root, как и ownV1Dir
+func (c *Cgroup) ownV2Dir(path string) string {
+	dir := filepath.Join(c.root, path)
+	if !fileExists(dir) {
+		return c.root
+	}
+	return dir
+}
+
+// ownV1Dir возвращает каталоги собственной cgroup по контроллерам. В контейнере
+// без cgroup namespace /proc/self/cgroup показывает путь на хосте, а в контейнер
+// смонтирован только его собственный каталог - тогда это корень контроллера
+func (c *Cgroup) ownV1Dir(own map[string]string) func(controller string) string {
+	return func(controller string) string {
+		dir := filepath.Join(c.root, controller, own[controller])
+		if !fileExists(dir) {
+			return filepath.Join(c.root, controller)
+		}
+		return dir
+	}
+}
+
+func (c *Cgroup) pids(metrics *serializers.Metrics, dir string, labels map[string]string) error {
+	if current, ok, err := readUint(filepath.Join(dir, "pids.current")); err != nil {
+		return err
+	} else if ok {
+		metrics.AddLabeled("CgroupPids", "gauge", current, labels)
+	}
+	if limit, ok, err := readUint(filepath.Join(dir, "pids.max")); err != nil {
+		return err
+	} else if ok {
+		metrics.AddLabeled("CgroupPidsLimit", "gauge", limit, labels)
+	}
+	return nil
+}
+
+// ioStatV2 разбирает строки вида "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+func (c *Cgroup) ioStatV2(metrics *serializers.Metrics, path, file string) error {
+	return readLines(file, func(fields []string) error {
+		if len(fields) < 2 {
+			return nil
+		}
+		device := fields[0]
+		stat := make(map[string]uint64)
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			stat[name] = v
+		}
+
+		labels := map[string]string{"cgroup": path, "device": device}
+		c.incDevice(metrics, "CgroupIOReadBytes", path, device, stat, "rbytes", labels)
+		c.incDevice(metrics, "CgroupIOWriteBytes", path, device, stat, "wbytes", labels)
+		c.incDevice(metrics, "CgroupIOReads", path, device, stat, "rios", labels)
+		c.incDevice(metrics, "CgroupIOWrites", path, device, stat, "wios", labels)
+		return nil
+	})
+}
+
+// ioStatV1 разбирает строки вида "8:0 Read 4096" из файлов blkio
+func (c *Cgroup) ioStatV1(metrics *serializers.Metrics, path, file, readID, writeID string) error {
+	return readLines(file, func(fields []string) error {
+		if len(fields) != 3 || (fields[1] != "Read" && fields[1] != "Write") {
+			return nil
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		id := readID
+		if fields[1] == "Write" {
+			id = writeID
+		}
+		c.incValue(metrics, id, path, fields[0], value, map[string]string{"cgroup": path, "device": fields[0]})
+		return nil
+	})
+}
+
+func (c *Cgroup) inc(metrics *serializers.Metrics, id, path string, stat map[string]uint64, key string, labels map[string]string) {
+	c.incDevice(metrics, id, path, "", stat, key, labels)
+}
+
+func (c *Cgroup) incDevice(metrics *serializers.Metrics, id, path, device string, stat map[string]uint64, key string, labels map[string]string) {
+	if value, ok := stat[key]; ok {
+		c.incValue(metrics, id, path, device, value, labels)
+	}
+}
+
+func (c *Cgroup) incValue(metrics *serializers.Metrics, id, path, device string, value uint64, labels map[string]string) {
+	c.counters.inc(metrics, id, path+"/"+device, value, labels)
+}
+
+// parseSelfCgroup разбирает строки вида "4:memory:/docker/abc" из /proc/self/cgroup
+// в пути по контроллерам. Путь cgroup v2 записан под пустым именем контроллера
+func parseSelfCgroup(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("собственная cgroup: %w", err)
+	}
+
+	paths := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: собственная cgroup не найдена", file)
+	}
+	return paths, nil
+}
+
+func cleanCgroupPath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+// readUint читает файл с одним числом. ok равно false, если файла нет
+// или в нём "max" - лимит не задан
+func readUint(file string) (value uint64, ok bool, err error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %w", file, err)
+	}
+	return value, true, nil
+}
+
+// readKeyValues читает файл из строк "key value", как cpu.stat или memory.events.
+// Если файла нет, например контроллер не включён, возвращает пустой набор
+func readKeyValues(file string) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	err := readLines(file, func(fields []string) error {
+		if len(fields) != 2 {
+			return nil
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		values[fields[0]] = v
+		return nil
+	})
+	return values, err
+}
+
+// readLines вызывает fn для полей каждой строки файла. Отсутствие файла не ошибка
+func readLines(file string, fn func(fields []string) error) error {
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
@@ -0,0 +1,141 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCgroup(version string, paths []string) *Cgroup {
+	c := NewCgroup(filepath.Join("testdata", "cgroup", version, "root"), paths)
+	c.selfCgroup = filepath.Join("testdata", "cgroup", version, "self")
+	return c
+}
+
+func requireMetric(t *testing.T, metrics *serializers.Metrics, key string, want float64) {
+	t.Helper()
+
+	metric, exist := findMetric(metrics, key)
+	require.True(t, exist, key)
+	if metric.Delta != nil {
+		require.Equal(t, int64(want), *metric.Delta, key)
+		return
+	}
+	require.Equal(t, want, *metric.Value, key)
+}
+
+func TestCgroupV2(t *testing.T) {
+	for name, paths := range map[string][]string{
+		"own":        nil,
+		"configured": {"system.slice/app.service/"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			metrics := serializers.InitMetrics("", nil)
+			require.NoError(t, newTestCgroup("v2", paths).Collect(context.Background(), metrics))
+
+			labels := `{cgroup="/system.slice/app.service"}`
+			requireMetric(t, metrics, "CgroupMemoryUsage"+labels, 104857600)
+			requireMetric(t, metrics, "CgroupMemoryLimit"+labels, 268435456)
+			requireMetric(t, metrics, "CgroupPids"+labels, 12)
+			// первый сбор только запоминает накопительные значения
+			requireMetric(t, metrics, "CgroupCPUThrottledPeriods"+labels, 0)
+			requireMetric(t, metrics, "CgroupOOMKills"+labels, 0)
+			requireMetric(t, metrics, `CgroupIOReadBytes{cgroup="/system.slice/app.service",device="8:0"}`, 0)
+
+			// лимит "max" не отправляется
+			_, exist := findMetric(metrics, "CgroupPidsLimit"+labels)
+			require.False(t, exist)
+		})
+	}
+}
+
+// В root смонтирована только cgroup контейнера, пути из /proc/self/cgroup под ним нет
+func TestCgroupV2Namespace(t *testing.T) {
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, newTestCgroup("v2ns", nil).Collect(context.Background(), metrics))
+
+	labels := `{cgroup="/system.slice/docker-abc.scope"}`
+	requireMetric(t, metrics, "CgroupMemoryUsage"+labels, 52428800)
+	requireMetric(t, metrics, "CgroupPids"+labels, 3)
+	requireMetric(t, metrics, "CgroupCPUUsageUsec"+labels, 0)
+
+	_, exist := findMetric(metrics, "CgroupMemoryLimit"+labels)
+	require.False(t, exist)
+
+	// заданный явно путь без каталога - ошибка, а не подмена корнем
+	err := newTestCgroup("v2ns", []string{"/system.slice/docker-abc.scope"}).Collect(context.Background(), metrics)
+	require.Error(t, err)
+}
+
+func TestCgroupMissing(t *testing.T) {
+	dir := t.TempDir()
+	metrics := serializers.InitMetrics("", nil)
+
+	c := NewCgroup(filepath.Join(dir, "cgroup"), nil)
+	c.selfCgroup = filepath.Join(dir, "self")
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	require.Empty(t, metrics.GetAll())
+
+	// явно заданная cgroup без файловой системы cgroup - ошибка
+	c = NewCgroup(filepath.Join(dir, "cgroup"), []string{"/app"})
+	require.Error(t, c.Collect(context.Background(), metrics))
+}
+
+func TestCgroupV1(t *testing.T) {
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, newTestCgroup("v1", nil).Collect(context.Background(), metrics))
+
+	labels := `{cgroup="/docker/abc"}`
+	requireMetric(t, metrics, "CgroupMemoryUsage"+labels, 52428800)
+	requireMetric(t, metrics, "CgroupPids"+labels, 4)
+	requireMetric(t, metrics, "CgroupPidsLimit"+labels, 100)
+	requireMetric(t, metrics, "CgroupCPUUsageUsec"+labels, 0)
+	requireMetric(t, metrics, "CgroupOOMKills"+labels, 0)
+	requireMetric(t, metrics, `CgroupIOWrites{cgroup="/docker/abc",device="8:0"}`, 0)
+
+	// без ограничения памяти в v1 записано огромное число
+	_, exist := findMetric(metrics, "CgroupMemoryLimit"+labels)
+	require.False(t, exist)
+
+	err := newTestCgroup("v1", []string{"/docker/missing"}).Collect(context.Background(), metrics)
+	require.Error(t, err)
+}
+
+func TestCgroupCounters(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "app")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory io pids\n"), 0644))
+
+	write := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("cpu.stat", "usage_usec 1000\nnr_periods 10\nnr_throttled 1\nthrottled_usec 100\n")
+	write("memory.events", "oom 0\noom_kill 0\n")
+	write("io.stat", "8:0 rbytes=100 wbytes=0 rios=1 wios=0\n")
+
+	c := NewCgroup(root, []string{"app"})
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	write("cpu.stat", "usage_usec 4000\nnr_periods 20\nnr_throttled 6\nthrottled_usec 900\n")
+	write("memory.events", "oom 1\noom_kill 1\n")
+	write("io.stat", "8:0 rbytes=600 wbytes=0 rios=3 wios=0\n")
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	labels := `{cgroup="/app"}`
+	requireMetric(t, metrics, "CgroupCPUUsageUsec"+labels, 3000)
+	requireMetric(t, metrics, "CgroupCPUThrottledPeriods"+labels, 5)
+	requireMetric(t, metrics, "CgroupCPUThrottledUsec"+labels, 800)
+	requireMetric(t, metrics, "CgroupOOMEvents"+labels, 1)
+	requireMetric(t, metrics, "CgroupOOMKills"+labels, 1)
+	requireMetric(t, metrics, `CgroupIOReadBytes{cgroup="/app",device="8:0"}`, 500)
+
+	// у контейнера без ограничения памяти лимита нет
+	_, exist := findMetric(metrics, "CgroupMemoryLimit"+labels)
+	require.False(t, exist)
+}
@@ -0,0 +1,180 @@
+// Пакет collector описывает сборщики метрик агента и запускает их по расписанию
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/rs/zerolog/log"
+)
+
+// Collector собирает группу метрик и складывает их в коллекцию
+type Collector interface {
+	// Name - имя сборщика, по нему сборщик включается в конфиге
+	Name() string
+	// Interval - период сбора. Ноль означает период по умолчанию
+	Interval() time.Duration
+	Collect(ctx context.Context, metrics *serializers.Metrics) error
+}
+
+// Registry хранит все известные агенту сборщики
+type Registry struct {
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// Register добавляет сборщик. Имена сборщиков уникальны
+func (r *Registry) Register(c Collector) error {
+	if _, exist := r.collectors[c.Name()]; exist {
+		return fmt.Errorf("сборщик %q уже зарегистрирован", c.Name())
+	}
+	r.collectors[c.Name()] = c
+	return nil
+}
+
+// Names возвращает имена зарегистрированных сборщиков по алфавиту
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select возвращает включённые сборщики. intervals переопределяет период сбора,
+// сборщики без своего периода собираются раз в defaultInterval
+func (r *Registry) Select(enabled []string, intervals map[string]time.Duration, defaultInterval time.Duration) ([]Collector, error) {
+	for name := range intervals {
+		if _, exist := r.collectors[name]; !exist {
+			return nil, fmt.Errorf("неизвестный сборщик %q", name)
+		}
+	}
+
+	selected := make([]Collector, 0, len(enabled))
+	seen := make(map[string]bool)
+	for _, name := range enabled {
+		c, exist := r.collectors[name]
+		if !exist {
+			return nil, fmt.Errorf("неизвестный сборщик %q, доступны: %s", name, strings.Join(r.Names(), ","))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		interval := c.Interval()
+		if d, ok := intervals[name]; ok {
+			interval = d
+		}
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("не задан период сбора для %q", name)
+		}
+
+		selected = append(selected, scheduled{Collector: c, interval: interval})
+	}
+
+	return selected, nil
+}
+
+// scheduled подменяет период сбора сборщика на период из конфига
+type scheduled struct {
+	Collector
+	interval time.Duration
+}
+
+func (s scheduled) Interval() time.Duration {
+	return s.interval
+}
+
+// Start запускает каждый сборщик в своей горутине со своим периодом.
+// Горутины завершаются вместе с ctx, wg позволяет их дождаться
+func Start(ctx context.Context, collectors []Collector, metrics *serializers.Metrics, wg *sync.WaitGroup) {
+	for _, c := range collectors {
+		wg.Add(1)
+		go func(c Collector) {
+			defer wg.Done()
+
+			// медленный сборщик пропускает такты, а не копит горутины
+			tick := time.NewTicker(c.Interval())
+			defer tick.Stop()
+			for {
+				select {
+				case <-tick.C:
+					Collect(ctx, c, metrics)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(c)
+	}
+}
+
+// Collect один раз запускает сборщик и добавляет метрики о самом сборе:
+// CollectorDuration - длительность в секундах и CollectorErrors - число ошибок
+func Collect(ctx context.Context, c Collector, metrics *serializers.Metrics) {
+	labels := map[string]string{"collector": c.Name()}
+
+	start := time.Now()
+	err := c.Collect(ctx, metrics)
+
+	// при остановке агента сбор прерывается, это не ошибка
+	if ctx.Err() != nil {
+		return
+	}
+
+	metrics.AddLabeled("CollectorDuration", "gauge", time.Since(start).Seconds(), labels)
+	if err != nil {
+		log.Error().Err(err).Str("collector", c.Name()).Msg("Ошибка при сборе метрик")
+		metrics.Inc("CollectorErrors", 1, labels)
+		return
+	}
+
+	// нулевое значение, чтобы ряд существовал до первой ошибки
+	metrics.Inc("CollectorErrors", 0, labels)
+}
+
+// ParseNames разбирает список имён через запятую
+func ParseNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseIntervals разбирает строку вида system=10s,runtime=2s
+func ParseIntervals(s string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, pair := range ParseNames(s) {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("неверный формат периода %q, ожидается name=duration", pair)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("неверный период сборщика %q: %w", name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("период сборщика %q должен быть больше нуля", name)
+		}
+		intervals[name] = d
+	}
+
+	return intervals, nil
+}
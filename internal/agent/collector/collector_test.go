@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCollector struct {
+	name     string
+	interval time.Duration
+	err      error
+	calls    int
+	mu       sync.Mutex
+}
+
+func (c *fakeCollector) Name() string            { return c.name }
+func (c *fakeCollector) Interval() time.Duration { return c.interval }
+
+func (c *fakeCollector) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	metrics.Add(c.name+"Value", "gauge", 1.0)
+	return c.err
+}
+
+func findMetric(metrics *serializers.Metrics, key string) (serializers.Metric, bool) {
+	for _, metric := range metrics.GetAll() {
+		if metric.Key() == key {
+			return metric, true
+		}
+	}
+	return serializers.Metric{}, false
+}
+
+func TestRegistrySelect(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Register(&fakeCollector{name: "fast"}))
+	require.NoError(t, registry.Register(&fakeCollector{name: "slow", interval: time.Minute}))
+	require.Error(t, registry.Register(&fakeCollector{name: "fast"}))
+	require.Equal(t, []string{"fast", "slow"}, registry.Names())
+
+	selected, err := registry.Select([]string{"slow", "fast"}, nil, time.Second)
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	require.Equal(t, time.Minute, selected[0].Interval())
+	require.Equal(t, time.Second, selected[1].Interval())
+
+	selected, err = registry.Select([]string{"slow"}, map[string]time.Duration{"slow": 5 * time.Second}, time.Second)
+	require.NoError(t, err)
+	require.Len(t, selected, 1)
+	require.Equal(t, 5*time.Second, selected[0].Interval())
+
+	_, err = registry.Select([]string{"unknown"}, nil, time.Second)
+	require.Error(t, err)
+
+	_, err = registry.Select([]string{"fast"}, map[string]time.Duration{"unknown": time.Second}, time.Second)
+	require.Error(t, err)
+}
+
+func TestParseIntervals(t *testing.T) {
+	intervals, err := ParseIntervals(" system=10s, runtime=2s ")
+	require.NoError(t, err)
+	require.Equal(t, map[string]time.Duration{"system": 10 * time.Second, "runtime": 2 * time.Second}, intervals)
+
+	_, err = ParseIntervals("system")
+	require.Error(t, err)
+	_, err = ParseIntervals("system=fast")
+	require.Error(t, err)
+	_, err = ParseIntervals("system=0s")
+	require.Error(t, err)
+
+	require.Equal(t, []string{"runtime", "system"}, ParseNames("runtime, ,system"))
+}
+
+func TestCollectSelfMetrics(t *testing.T) {
+	metrics := serializers.InitMetrics("", nil)
+
+	ok := &fakeCollector{name: "ok"}
+	failing := &fakeCollector{name: "failing", err: errors.New("boom")}
+
+	Collect(context.Background(), ok, metrics)
+	Collect(context.Background(), failing, metrics)
+	Collect(context.Background(), failing, metrics)
+
+	errs, exist := findMetric(metrics, `CollectorErrors{collector="ok"}`)
+	require.True(t, exist)
+	require.Equal(t, int64(0), *errs.Delta)
+
+	errs, exist = findMetric(metrics, `CollectorErrors{collector="failing"}`)
+	require.True(t, exist)
+	require.Equal(t, int64(2), *errs.Delta)
+
+	_, exist = findMetric(metrics, `CollectorDuration{collector="failing"}`)
+	require.True(t, exist)
+
+	// отправленные ошибки вычитаются, новые продолжают копиться
+	metrics.Sent([]serializers.Metric{errs})
+	Collect(context.Background(), failing, metrics)
+	errs, _ = findMetric(metrics, `CollectorErrors{collector="failing"}`)
+	require.Equal(t, int64(1), *errs.Delta)
+}
+
+func TestStart(t *testing.T) {
+	metrics := serializers.InitMetrics("", nil)
+	c := &fakeCollector{name: "fast", interval: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	Start(ctx, []Collector{c}, metrics, &wg)
+
+	require.Eventually(t, func() bool {
+		_, exist := metrics.Get("fastValue")
+		return exist
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	wg.Wait()
+}
+
+func TestRuntimePollCount(t *testing.T) {
+	metrics := serializers.InitMetrics("", nil)
+	c := NewRuntime()
+
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	pollCount, exist := metrics.Get("PollCount")
+	require.True(t, exist)
+	require.Equal(t, int64(2), *pollCount.Delta)
+
+	_, exist = metrics.Get("HeapAlloc")
+	require.True(t, exist)
+
+	// опрос между формированием батча и его отправкой не теряется
+	batch := metrics.GetAll()
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	metrics.Sent(batch)
+
+	pollCount, exist = metrics.Get("PollCount")
+	require.True(t, exist)
+	require.Equal(t, int64(1), *pollCount.Delta)
+}
@@ -0,0 +1,31 @@
+package collector
+
+import "github.com/region23/go-musthave-devops/internal/serializers"
+
+// counters превращает накопительные значения, например байты, прочитанные
+// с устройства с момента загрузки, в приращения между сборами
+type counters struct {
+	last map[string]uint64
+}
+
+func newCounters() *counters {
+	return &counters{last: make(map[string]uint64)}
+}
+
+// delta возвращает приращение значения с прошлого сбора. При первом сборе
+// и после сброса счётчика, например при переподключении устройства,
+// приращение неизвестно и считается нулевым
+func (c *counters) delta(key string, value uint64) int64 {
+	last, seen := c.last[key]
+	c.last[key] = value
+	if !seen || value < last {
+		return 0
+	}
+	return int64(value - last)
+}
+
+// inc добавляет к счётчику id приращение значения объекта, например устройства.
+// При первом сборе добавляется ноль, чтобы ряд появился сразу
+func (c *counters) inc(metrics *serializers.Metrics, id, object string, value uint64, labels map[string]string) {
+	metrics.Inc(id, c.delta(id+"/"+object, value), labels)
+}
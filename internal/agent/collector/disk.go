@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Filesystem собирает заполненность файловых систем по точкам монтирования:
+// байты и inode, всего, занято и свободно
+type Filesystem struct {
+	mountpoints Filter
+
+	partitions func(ctx context.Context, all bool) ([]disk.PartitionStat, error)
+	usage      func(ctx context.Context, path string) (*disk.UsageStat, error)
+}
+
+// NewFilesystem собирает только физические файловые системы, отобранные mountpoints
+func NewFilesystem(mountpoints Filter) *Filesystem {
+	return &Filesystem{
+		mountpoints: mountpoints,
+		partitions:  disk.PartitionsWithContext,
+		usage:       disk.UsageWithContext,
+	}
+}
+
+func (c *Filesystem) Name() string {
+	return "filesystem"
+}
+
+func (c *Filesystem) Interval() time.Duration {
+	return 0
+}
+
+func (c *Filesystem) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	partitions, err := c.partitions(ctx, false)
+	if err != nil {
+		return fmt.Errorf("список файловых систем: %w", err)
+	}
+
+	// одна недоступная точка монтирования, например отвалившийся NFS,
+	// не мешает собрать остальные
+	var firstErr error
+	for _, partition := range partitions {
+		if !c.mountpoints.Match(partition.Mountpoint) {
+			continue
+		}
+
+		usage, err := c.usage(ctx, partition.Mountpoint)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("файловая система %s: %w", partition.Mountpoint, err)
+			}
+			continue
+		}
+
+		labels := map[string]string{
+			"mountpoint": partition.Mountpoint,
+			"device":     partition.Device,
+			"fstype":     partition.Fstype,
+		}
+		metrics.AddLabeled("DiskTotal", "gauge", usage.Total, labels)
+		metrics.AddLabeled("DiskUsed", "gauge", usage.Used, labels)
+		metrics.AddLabeled("DiskFree", "gauge", usage.Free, labels)
+		metrics.AddLabeled("DiskUsedPercent", "gauge", usage.UsedPercent, labels)
+		// у некоторых файловых систем, например btrfs, inode не ограничены
+		if usage.InodesTotal > 0 {
+			metrics.AddLabeled("DiskInodesTotal", "gauge", usage.InodesTotal, labels)
+			metrics.AddLabeled("DiskInodesUsed", "gauge", usage.InodesUsed, labels)
+			metrics.AddLabeled("DiskInodesFree", "gauge", usage.InodesFree, labels)
+		}
+	}
+
+	return firstErr
+}
+
+// DiskIO собирает ввод-вывод блочных устройств: прочитанные и записанные байты
+// и число операций. Значения отправляются счётчиками - приращением с прошлого сбора
+type DiskIO struct {
+	devices  Filter
+	counters *counters
+
+	ioCounters func(ctx context.Context, names ...string) (map[string]disk.IOCountersStat, error)
+}
+
+// NewDiskIO собирает устройства, отобранные devices
+func NewDiskIO(devices Filter) *DiskIO {
+	return &DiskIO{
+		devices:    devices,
+		counters:   newCounters(),
+		ioCounters: disk.IOCountersWithContext,
+	}
+}
+
+func (c *DiskIO) Name() string {
+	return "diskio"
+}
+
+func (c *DiskIO) Interval() time.Duration {
+	return 0
+}
+
+func (c *DiskIO) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	stats, err := c.ioCounters(ctx)
+	if err != nil {
+		return fmt.Errorf("ввод-вывод устройств: %w", err)
+	}
+
+	for name, stat := range stats {
+		if !c.devices.Match(name) {
+			continue
+		}
+
+		labels := map[string]string{"device": name}
+		c.counters.inc(metrics, "DiskReadBytes", name, stat.ReadBytes, labels)
+		c.counters.inc(metrics, "DiskWriteBytes", name, stat.WriteBytes, labels)
+		c.counters.inc(metrics, "DiskReads", name, stat.ReadCount, labels)
+		c.counters.inc(metrics, "DiskWrites", name, stat.WriteCount, labels)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter("", "loop*,ram*")
+	require.NoError(t, err)
+	require.True(t, f.Match("sda"))
+	require.False(t, f.Match("loop0"))
+
+	f, err = NewFilter("/,/data*", "/data/tmp")
+	require.NoError(t, err)
+	require.True(t, f.Match("/"))
+	require.True(t, f.Match("/data1"))
+	require.False(t, f.Match("/boot"))
+
+	_, err = NewFilter("[", "")
+	require.Error(t, err)
+}
+
+func TestFilesystem(t *testing.T) {
+	mountpoints, err := NewFilter("", "/boot")
+	require.NoError(t, err)
+
+	c := NewFilesystem(mountpoints)
+	c.partitions = func(ctx context.Context, all bool) ([]disk.PartitionStat, error) {
+		return []disk.PartitionStat{
+			{Device: "/dev/sda1", Mountpoint: "/", Fstype: "ext4"},
+			{Device: "/dev/sda2", Mountpoint: "/boot", Fstype: "ext4"},
+			{Device: "nfs:/export", Mountpoint: "/mnt/nfs", Fstype: "nfs"},
+		}, nil
+	}
+	c.usage = func(ctx context.Context, path string) (*disk.UsageStat, error) {
+		require.NotEqual(t, "/boot", path)
+		if path == "/mnt/nfs" {
+			return nil, errors.New("stale file handle")
+		}
+		return &disk.UsageStat{Total: 100, Used: 75, Free: 25, UsedPercent: 75, InodesTotal: 10, InodesUsed: 4, InodesFree: 6}, nil
+	}
+
+	metrics := serializers.InitMetrics("", nil)
+	require.Error(t, c.Collect(context.Background(), metrics))
+
+	labels := `{device="/dev/sda1",fstype="ext4",mountpoint="/"}`
+	free, exist := findMetric(metrics, "DiskFree"+labels)
+	require.True(t, exist)
+	require.Equal(t, float64(25), *free.Value)
+
+	inodes, exist := findMetric(metrics, "DiskInodesFree"+labels)
+	require.True(t, exist)
+	require.Equal(t, float64(6), *inodes.Value)
+
+	_, exist = findMetric(metrics, `DiskFree{device="/dev/sda2",fstype="ext4",mountpoint="/boot"}`)
+	require.False(t, exist)
+}
+
+func TestDiskIO(t *testing.T) {
+	devices, err := NewFilter("", "loop*")
+	require.NoError(t, err)
+
+	readBytes := uint64(1000)
+	c := NewDiskIO(devices)
+	c.ioCounters = func(ctx context.Context, names ...string) (map[string]disk.IOCountersStat, error) {
+		return map[string]disk.IOCountersStat{
+			"sda":   {Name: "sda", ReadBytes: readBytes, WriteBytes: 10, ReadCount: 5, WriteCount: 1},
+			"loop0": {Name: "loop0", ReadBytes: 1},
+		}, nil
+	}
+
+	metrics := serializers.InitMetrics("", nil)
+	readDelta := func() int64 {
+		metric, exist := findMetric(metrics, `DiskReadBytes{device="sda"}`)
+		require.True(t, exist)
+		return *metric.Delta
+	}
+
+	// первый сбор только запоминает значения
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	require.Equal(t, int64(0), readDelta())
+
+	readBytes = 1500
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	readBytes = 1600
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	require.Equal(t, int64(600), readDelta())
+
+	// после сброса счётчика устройства приращение не уходит в минус
+	readBytes = 100
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	require.Equal(t, int64(600), readDelta())
+
+	_, exist := findMetric(metrics, `DiskReadBytes{device="loop0"}`)
+	require.False(t, exist)
+}
@@ -0,0 +1,41 @@
+package collector
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Filter отбирает объекты сбора, например точки монтирования или устройства,
+// по шаблонам filepath.Match. Пустой список include пропускает всё,
+// exclude проверяется после include
+type Filter struct {
+	include []string
+	exclude []string
+}
+
+// NewFilter принимает шаблоны через запятую, например "/,/data*" и "loop*"
+func NewFilter(include, exclude string) (Filter, error) {
+	f := Filter{include: ParseNames(include), exclude: ParseNames(exclude)}
+	for _, pattern := range append(append([]string{}, f.include...), f.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return Filter{}, fmt.Errorf("неверный шаблон %q: %w", pattern, err)
+		}
+	}
+	return f, nil
+}
+
+func (f Filter) Match(name string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return false
+	}
+	return !matchAny(f.exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// Network собирает трафик сетевых интерфейсов: байты, пакеты, ошибки и
+// отброшенные пакеты в каждую сторону. Значения отправляются счётчиками
+type Network struct {
+	interfaces Filter
+	counters   *counters
+
+	ioCounters func(ctx context.Context, pernic bool) ([]net.IOCountersStat, error)
+}
+
+// NewNetwork собирает интерфейсы, отобранные interfaces
+func NewNetwork(interfaces Filter) *Network {
+	return &Network{
+		interfaces: interfaces,
+		counters:   newCounters(),
+		ioCounters: net.IOCountersWithContext,
+	}
+}
+
+func (c *Network) Name() string {
+	return "network"
+}
+
+func (c *Network) Interval() time.Duration {
+	return 0
+}
+
+func (c *Network) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	stats, err := c.ioCounters(ctx, true)
+	if err != nil {
+		return fmt.Errorf("счётчики интерфейсов: %w", err)
+	}
+
+	for _, stat := range stats {
+		if !c.interfaces.Match(stat.Name) {
+			continue
+		}
+
+		labels := map[string]string{"interface": stat.Name}
+		c.counters.inc(metrics, "NetBytesSent", stat.Name, stat.BytesSent, labels)
+		c.counters.inc(metrics, "NetBytesRecv", stat.Name, stat.BytesRecv, labels)
+		c.counters.inc(metrics, "NetPacketsSent", stat.Name, stat.PacketsSent, labels)
+		c.counters.inc(metrics, "NetPacketsRecv", stat.Name, stat.PacketsRecv, labels)
+		c.counters.inc(metrics, "NetErrIn", stat.Name, stat.Errin, labels)
+		c.counters.inc(metrics, "NetErrOut", stat.Name, stat.Errout, labels)
+		c.counters.inc(metrics, "NetDropIn", stat.Name, stat.Dropin, labels)
+		c.counters.inc(metrics, "NetDropOut", stat.Name, stat.Dropout, labels)
+	}
+
+	return nil
+}
+
+// Состояния TCP-соединений, которые отправляются всегда, даже с нулём
+var tcpStates = []string{
+	"ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING",
+}
+
+// TCP собирает число TCP-соединений хоста, IPv4 и IPv6, по состояниям
+type TCP struct {
+	connections func(ctx context.Context, kind string) ([]net.ConnectionStat, error)
+}
+
+func NewTCP() *TCP {
+	return &TCP{connections: net.ConnectionsWithoutUidsWithContext}
+}
+
+func (c *TCP) Name() string {
+	return "tcp"
+}
+
+// Для привязки соединений к процессам gopsutil обходит дескрипторы всех
+// процессов, на нагруженном хосте это дорого
+func (c *TCP) Interval() time.Duration {
+	return 10 * time.Second
+}
+
+func (c *TCP) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	connections, err := c.connections(ctx, "tcp")
+	if err != nil {
+		return fmt.Errorf("список TCP-соединений: %w", err)
+	}
+
+	counts := make(map[string]int, len(tcpStates))
+	for _, state := range tcpStates {
+		counts[state] = 0
+	}
+	for _, connection := range connections {
+		counts[connection.Status]++
+	}
+
+	for state, count := range counts {
+		metrics.AddLabeled("TCPConnections", "gauge", count, map[string]string{"state": state})
+	}
+
+	return nil
+}
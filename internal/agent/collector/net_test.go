@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetwork(t *testing.T) {
+	interfaces, err := NewFilter("", "lo")
+	require.NoError(t, err)
+
+	var sent, dropped uint64 = 100, 0
+	c := NewNetwork(interfaces)
+	c.ioCounters = func(ctx context.Context, pernic bool) ([]net.IOCountersStat, error) {
+		require.True(t, pernic)
+		return []net.IOCountersStat{
+			{Name: "eth0", BytesSent: sent, Dropin: dropped},
+			{Name: "lo", BytesSent: 1 << 30},
+		}, nil
+	}
+
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	sent, dropped = 350, 3
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	bytesSent, exist := findMetric(metrics, `NetBytesSent{interface="eth0"}`)
+	require.True(t, exist)
+	require.Equal(t, int64(250), *bytesSent.Delta)
+
+	drops, exist := findMetric(metrics, `NetDropIn{interface="eth0"}`)
+	require.True(t, exist)
+	require.Equal(t, int64(3), *drops.Delta)
+
+	_, exist = findMetric(metrics, `NetBytesSent{interface="lo"}`)
+	require.False(t, exist)
+}
+
+func TestTCP(t *testing.T) {
+	c := NewTCP()
+	c.connections = func(ctx context.Context, kind string) ([]net.ConnectionStat, error) {
+		require.Equal(t, "tcp", kind)
+		return []net.ConnectionStat{
+			{Status: "LISTEN"},
+			{Status: "ESTABLISHED"},
+			{Status: "ESTABLISHED"},
+		}, nil
+	}
+
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	established, exist := findMetric(metrics, `TCPConnections{state="ESTABLISHED"}`)
+	require.True(t, exist)
+	require.Equal(t, float64(2), *established.Value)
+
+	timeWait, exist := findMetric(metrics, `TCPConnections{state="TIME_WAIT"}`)
+	require.True(t, exist)
+	require.Equal(t, float64(0), *timeWait.Value)
+}
@@ -0,0 +1,353 @@
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ProcessSelectors задаёт, за какими процессами следить
+type ProcessSelectors struct {
+	Names    []string // шаблоны имени процесса для filepath.Match, например "nginx*"
+	PIDFiles []string // пути к PID-файлам
+	Cgroups  []string // каталоги cgroup, процессы берутся из cgroup.procs
+}
+
+func (s ProcessSelectors) empty() bool {
+	return len(s.Names) == 0 && len(s.PIDFiles) == 0 && len(s.Cgroups) == 0
+}
+
+// Process собирает загрузку процессора, RSS, число открытых дескрипторов
+// и потоков и время работы выбранных процессов. Метрики складываются по имени
+// процесса, чтобы перезапуск или новый рабочий процесс не давали новых рядов.
+// ProcessCount показывает, сколько живых процессов нашлось по каждому
+// селектору - ноль значит, что сервис не запущен
+type Process struct {
+	selectors ProcessSelectors
+
+	// процессы с прошлого сбора, gopsutil считает загрузку процессора
+	// между вызовами на одном и том же объекте
+	tracked map[int32]*trackedProcess
+	// ряды, отправленные на прошлом сборе. Ряды пропавших процессов
+	// удаляются из коллекции
+	reported map[processSeries]bool
+
+	processes func(ctx context.Context) ([]*process.Process, error)
+}
+
+type trackedProcess struct {
+	proc    *process.Process
+	created int64
+}
+
+// Процессы, найденные одним селектором, например {name="nginx*"}
+type selection struct {
+	labels map[string]string
+	pids   []int32
+}
+
+// Ряд метрики процесса: имя метрики и имя процесса
+type processSeries struct {
+	id      string
+	process string
+}
+
+// Сумма метрик процессов с одним именем
+type processStats struct {
+	// время работы самого старого процесса
+	uptime float64
+	// загрузка процессора известна только для процессов, которые уже были
+	// на прошлом сборе
+	cpu      float64
+	cpuKnown bool
+	rss      uint64
+	threads  int
+	// дескрипторы отправляются, только если удалось посчитать их у всех процессов
+	fds        int
+	fdsUnknown bool
+}
+
+func NewProcess(selectors ProcessSelectors) (*Process, error) {
+	for _, pattern := range selectors.Names {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("неверный шаблон имени процесса %q: %w", pattern, err)
+		}
+	}
+
+	return &Process{
+		selectors: selectors,
+		tracked:   make(map[int32]*trackedProcess),
+		reported:  make(map[processSeries]bool),
+		processes: process.ProcessesWithContext,
+	}, nil
+}
+
+func (c *Process) Name() string {
+	return "process"
+}
+
+func (c *Process) Interval() time.Duration {
+	return 0
+}
+
+func (c *Process) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	if c.selectors.empty() {
+		return nil
+	}
+
+	selections, firstErr := c.selectPIDs(ctx)
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	tracked := make(map[int32]*trackedProcess)
+	stats := make(map[string]*processStats)
+	for _, sel := range selections {
+		for _, pid := range sel.pids {
+			if _, ok := tracked[pid]; ok {
+				continue
+			}
+			t, fresh, err := c.track(ctx, pid)
+			if err != nil {
+				// процесс успел завершиться или PID-файл остался от него
+				continue
+			}
+			tracked[pid] = t
+
+			if err := sampleProcess(ctx, t, fresh, stats); err != nil {
+				fail(err)
+			}
+		}
+	}
+	c.tracked = tracked
+
+	// считаем только процессы, которые действительно есть
+	for _, sel := range selections {
+		alive := 0
+		for _, pid := range sel.pids {
+			if _, ok := tracked[pid]; ok {
+				alive++
+			}
+		}
+		metrics.AddLabeled("ProcessCount", "gauge", alive, sel.labels)
+	}
+
+	c.report(stats, metrics)
+
+	return firstErr
+}
+
+// selectPIDs возвращает процессы, найденные каждым из селекторов
+func (c *Process) selectPIDs(ctx context.Context) ([]selection, error) {
+	var selections []selection
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	add := func(selector, value string, found []int32) {
+		selections = append(selections, selection{labels: map[string]string{selector: value}, pids: found})
+	}
+
+	if len(c.selectors.Names) > 0 {
+		all, err := c.processes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("список процессов: %w", err)
+		}
+
+		byPattern := make(map[string][]int32, len(c.selectors.Names))
+		for _, p := range all {
+			name, err := p.NameWithContext(ctx)
+			if err != nil {
+				continue
+			}
+			for _, pattern := range c.selectors.Names {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					byPattern[pattern] = append(byPattern[pattern], p.Pid)
+				}
+			}
+		}
+		for _, pattern := range c.selectors.Names {
+			add("name", pattern, byPattern[pattern])
+		}
+	}
+
+	for _, path := range c.selectors.PIDFiles {
+		pid, err := readPIDFile(path)
+		if err != nil {
+			fail(err)
+			add("pidfile", path, nil)
+			continue
+		}
+		add("pidfile", path, []int32{pid})
+	}
+
+	for _, dir := range c.selectors.Cgroups {
+		found, err := readCgroupProcs(dir)
+		if err != nil {
+			fail(err)
+		}
+		add("cgroup", dir, found)
+	}
+
+	return selections, firstErr
+}
+
+// track возвращает процесс с прошлого сбора или начинает следить за новым,
+// тогда fresh равно true. PID мог достаться другому процессу, поэтому сверяем время запуска
+func (c *Process) track(ctx context.Context, pid int32) (t *trackedProcess, fresh bool, err error) {
+	p, err := process.NewProcessWithContext(ctx, pid)
+	if err != nil {
+		return nil, false, err
+	}
+	created, err := p.CreateTimeWithContext(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if t, ok := c.tracked[pid]; ok && t.created == created {
+		return t, false, nil
+	}
+
+	// первый замер только запоминает время процессора
+	if _, err := p.PercentWithContext(ctx, 0); err != nil {
+		return nil, false, err
+	}
+	return &trackedProcess{proc: p, created: created}, true, nil
+}
+
+// sampleProcess добавляет метрики процесса к сумме по его имени. Загрузку
+// процессора нового процесса узнаем только на следующем сборе
+func sampleProcess(ctx context.Context, t *trackedProcess, fresh bool, stats map[string]*processStats) error {
+	p := t.proc
+	name, err := p.NameWithContext(ctx)
+	if err != nil {
+		return nil
+	}
+
+	var cpu float64
+	if !fresh {
+		cpu, err = p.PercentWithContext(ctx, 0)
+		if err != nil {
+			return fmt.Errorf("процесс %d: %w", p.Pid, err)
+		}
+	}
+
+	memory, err := p.MemoryInfoWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("процесс %d: %w", p.Pid, err)
+	}
+
+	threads, err := p.NumThreadsWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("процесс %d: %w", p.Pid, err)
+	}
+
+	// дескрипторы чужих процессов видны только root, без них остальное полезно
+	fds, fdsErr := p.NumFDsWithContext(ctx)
+	if fdsErr != nil && !errors.Is(fdsErr, fs.ErrPermission) {
+		return fmt.Errorf("процесс %d: %w", p.Pid, fdsErr)
+	}
+
+	s, ok := stats[name]
+	if !ok {
+		s = &processStats{}
+		stats[name] = s
+	}
+
+	if uptime := time.Since(time.UnixMilli(t.created)).Seconds(); uptime > s.uptime {
+		s.uptime = uptime
+	}
+	if !fresh {
+		s.cpu += cpu
+		s.cpuKnown = true
+	}
+	s.rss += memory.RSS
+	s.threads += int(threads)
+	if fdsErr != nil {
+		s.fdsUnknown = true
+	}
+	s.fds += int(fds)
+
+	return nil
+}
+
+// report добавляет метрики по именам процессов и удаляет ряды, которых
+// на этом сборе нет
+func (c *Process) report(stats map[string]*processStats, metrics *serializers.Metrics) {
+	reported := make(map[processSeries]bool)
+	add := func(id, name string, val interface{}) {
+		metrics.AddLabeled(id, "gauge", val, map[string]string{"process": name})
+		reported[processSeries{id: id, process: name}] = true
+	}
+
+	for name, s := range stats {
+		add("ProcessUptime", name, s.uptime)
+		if s.cpuKnown {
+			add("ProcessCPUPercent", name, s.cpu)
+		}
+		add("ProcessRSS", name, s.rss)
+		add("ProcessThreads", name, s.threads)
+		if !s.fdsUnknown {
+			add("ProcessFDs", name, s.fds)
+		}
+	}
+
+	for series := range c.reported {
+		if !reported[series] {
+			metrics.Remove(series.id, map[string]string{"process": series.process})
+		}
+	}
+	c.reported = reported
+}
+
+func readPIDFile(path string) (int32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("PID-файл: %w", err)
+	}
+
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("PID-файл %s: неверный PID %q", path, strings.TrimSpace(string(data)))
+	}
+
+	return int32(pid), nil
+}
+
+// readCgroupProcs читает PID процессов из cgroup.procs. Файл есть и в cgroup v1, и в v2
+func readCgroupProcs(dir string) ([]int32, error) {
+	f, err := os.Open(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	defer f.Close()
+
+	var pids []int32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pid, err := strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cgroup %s: неверный PID %q", dir, scanner.Text())
+		}
+		pids = append(pids, int32(pid))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cgroup %s: %w", dir, err)
+	}
+
+	return pids, nil
+}
@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/process"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	pid := os.Getpid()
+
+	pidFile := filepath.Join(dir, "test.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", pid)), 0644))
+
+	cgroup := filepath.Join(dir, "cgroup")
+	require.NoError(t, os.Mkdir(cgroup, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(fmt.Sprintf("%d\n", pid)), 0644))
+
+	self, err := process.NewProcess(int32(pid))
+	require.NoError(t, err)
+	name, err := self.Name()
+	require.NoError(t, err)
+
+	c, err := NewProcess(ProcessSelectors{
+		Names:    []string{name, "no-such-process-*"},
+		PIDFiles: []string{pidFile},
+		Cgroups:  []string{cgroup},
+	})
+	require.NoError(t, err)
+
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	labels := fmt.Sprintf(`{process=%s}`, strconv.Quote(name))
+	rss, exist := findMetric(metrics, "ProcessRSS"+labels)
+	require.True(t, exist)
+	require.Greater(t, *rss.Value, float64(0))
+
+	_, exist = findMetric(metrics, "ProcessThreads"+labels)
+	require.True(t, exist)
+	_, exist = findMetric(metrics, "ProcessFDs"+labels)
+	require.True(t, exist)
+
+	// загрузка процессора появляется со второго сбора
+	_, exist = findMetric(metrics, "ProcessCPUPercent"+labels)
+	require.False(t, exist)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+	_, exist = findMetric(metrics, "ProcessCPUPercent"+labels)
+	require.True(t, exist)
+
+	for key, want := range map[string]float64{
+		fmt.Sprintf("ProcessCount{name=%s}", strconv.Quote(name)):       1,
+		`ProcessCount{name="no-such-process-*"}`:                        0,
+		fmt.Sprintf("ProcessCount{pidfile=%s}", strconv.Quote(pidFile)): 1,
+		fmt.Sprintf("ProcessCount{cgroup=%s}", strconv.Quote(cgroup)):   1,
+	} {
+		count, exist := findMetric(metrics, key)
+		require.True(t, exist, key)
+		require.Equal(t, want, *count.Value, key)
+	}
+}
+
+func TestProcessMissingPIDFile(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "missing.pid")
+	c, err := NewProcess(ProcessSelectors{PIDFiles: []string{pidFile}})
+	require.NoError(t, err)
+
+	metrics := serializers.InitMetrics("", nil)
+	require.Error(t, c.Collect(context.Background(), metrics))
+
+	count, exist := findMetric(metrics, fmt.Sprintf("ProcessCount{pidfile=%s}", strconv.Quote(pidFile)))
+	require.True(t, exist)
+	require.Equal(t, float64(0), *count.Value)
+
+	_, err = NewProcess(ProcessSelectors{Names: []string{"["}})
+	require.Error(t, err)
+}
+
+func TestProcessExited(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	pidFile := filepath.Join(t.TempDir(), "sleep.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644))
+
+	c, err := NewProcess(ProcessSelectors{PIDFiles: []string{pidFile}})
+	require.NoError(t, err)
+
+	metrics := serializers.InitMetrics("", nil)
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	countKey := fmt.Sprintf("ProcessCount{pidfile=%s}", strconv.Quote(pidFile))
+	count, exist := findMetric(metrics, countKey)
+	require.True(t, exist)
+	require.Equal(t, float64(1), *count.Value)
+	_, exist = findMetric(metrics, `ProcessRSS{process="sleep"}`)
+	require.True(t, exist)
+
+	// PID-файл остался от завершившегося процесса
+	require.NoError(t, cmd.Process.Kill())
+	cmd.Wait()
+	require.NoError(t, c.Collect(context.Background(), metrics))
+
+	count, exist = findMetric(metrics, countKey)
+	require.True(t, exist)
+	require.Equal(t, float64(0), *count.Value)
+	for _, id := range []string{"ProcessUptime", "ProcessRSS", "ProcessThreads", "ProcessFDs"} {
+		_, exist = findMetric(metrics, id+`{process="sleep"}`)
+		require.False(t, exist, id)
+	}
+}
@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+)
+
+// Runtime собирает статистику рантайма Go из runtime.MemStats,
+// случайное значение RandomValue и счётчик опросов PollCount
+type Runtime struct {
+	rand *rand.Rand
+}
+
+func NewRuntime() *Runtime {
+	return &Runtime{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (c *Runtime) Name() string {
+	return "runtime"
+}
+
+func (c *Runtime) Interval() time.Duration {
+	return 0
+}
+
+func (c *Runtime) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	metrics.Add("Alloc", "gauge", memStats.Alloc)
+	metrics.Add("BuckHashSys", "gauge", memStats.BuckHashSys)
+	metrics.Add("Frees", "gauge", memStats.Frees)
+	metrics.Add("GCCPUFraction", "gauge", memStats.GCCPUFraction)
+	metrics.Add("GCSys", "gauge", memStats.GCSys)
+	metrics.Add("HeapAlloc", "gauge", memStats.HeapAlloc)
+	metrics.Add("HeapIdle", "gauge", memStats.HeapIdle)
+	metrics.Add("HeapInuse", "gauge", memStats.HeapInuse)
+	metrics.Add("HeapObjects", "gauge", memStats.HeapObjects)
+	metrics.Add("HeapReleased", "gauge", memStats.HeapReleased)
+	metrics.Add("HeapSys", "gauge", memStats.HeapSys)
+	metrics.Add("LastGC", "gauge", memStats.LastGC)
+	metrics.Add("Lookups", "gauge", memStats.Lookups)
+	metrics.Add("MCacheInuse", "gauge", memStats.MCacheInuse)
+	metrics.Add("MCacheSys", "gauge", memStats.MCacheSys)
+	metrics.Add("MSpanInuse", "gauge", memStats.MSpanInuse)
+	metrics.Add("MSpanSys", "gauge", memStats.MSpanSys)
+	metrics.Add("Mallocs", "gauge", memStats.Mallocs)
+	metrics.Add("NextGC", "gauge", memStats.NextGC)
+	metrics.Add("NumForcedGC", "gauge", memStats.NumForcedGC)
+	metrics.Add("NumGC", "gauge", memStats.NumGC)
+	metrics.Add("OtherSys", "gauge", memStats.OtherSys)
+	metrics.Add("PauseTotalNs", "gauge", memStats.PauseTotalNs)
+	metrics.Add("StackInuse", "gauge", memStats.StackInuse)
+	metrics.Add("StackSys", "gauge", memStats.StackSys)
+	metrics.Add("Sys", "gauge", memStats.Sys)
+	metrics.Add("TotalAlloc", "gauge", memStats.TotalAlloc)
+
+	metrics.Add("RandomValue", "gauge", c.rand.Float64())
+
+	metrics.Inc("PollCount", 1, nil)
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// System собирает загрузку каждого процессора и объём памяти хоста.
+// Загрузка считается с момента предыдущего сбора, поэтому сбор не блокируется
+// на время замера, а окно замера равно периоду сбора
+type System struct{}
+
+func NewSystem() *System {
+	return &System{}
+}
+
+func (c *System) Name() string {
+	return "system"
+}
+
+// Загрузка за слишком короткое окно сильно скачет
+func (c *System) Interval() time.Duration {
+	return 10 * time.Second
+}
+
+func (c *System) Collect(ctx context.Context, metrics *serializers.Metrics) error {
+	cpuUtilization, cpuErr := cpu.PercentWithContext(ctx, 0, true)
+	if cpuErr != nil {
+		cpuErr = fmt.Errorf("загрузка процессоров: %w", cpuErr)
+	}
+
+	for i := 0; i < len(cpuUtilization); i++ {
+		metrics.Add(fmt.Sprintf("%s%d", "CPUutilization", i+1), "gauge", cpuUtilization[i])
+	}
+
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("виртуальная память: %w", err)
+	}
+
+	metrics.Add("TotalMemory", "gauge", v.Total)
+	metrics.Add("FreeMemory", "gauge", v.Free)
+
+	return cpuErr
+}
@@ -0,0 +1,105 @@
+// Пакет retry реализует повтор отправки с экспоненциальной задержкой и джиттером
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Policy struct {
+	MaxAttempts       int           // максимальное число попыток, включая первую
+	BaseDelay         time.Duration // задержка перед второй попыткой, далее удваивается
+	MaxDelay          time.Duration // верхняя граница задержки
+	Jitter            float64       // доля случайного отклонения задержки, от 0 до 1
+	RetryableStatuses []int         // HTTP-статусы, при которых запрос повторяется
+}
+
+// Ошибка с HTTP-статусом ответа сервера
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server responded with status %d", e.Code)
+}
+
+// Do вызывает fn, пока она не завершится успешно, не вернёт неповторяемую
+// ошибку или не закончатся попытки. Возвращает последнюю ошибку fn.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || !p.Retryable(err) || attempt >= attempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Retryable сообщает, имеет ли смысл повторять запрос после ошибки.
+// Сетевые ошибки повторяются всегда, ответы сервера - только с разрешёнными статусами.
+func (p Policy) Retryable(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	for _, code := range p.RetryableStatuses {
+		if code == statusErr.Code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delay возвращает задержку перед попыткой attempt+1
+func (p Policy) Delay(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// ParseStatuses разбирает список статусов вида 429,502,503
+func ParseStatuses(s string) ([]int, error) {
+	statuses := []int{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		code, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("неверный HTTP-статус %q", item)
+		}
+		statuses = append(statuses, code)
+	}
+
+	return statuses, nil
+}
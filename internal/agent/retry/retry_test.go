@@ -0,0 +1,73 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	require.Equal(t, 100*time.Millisecond, p.Delay(1))
+	require.Equal(t, 200*time.Millisecond, p.Delay(2))
+	require.Equal(t, 400*time.Millisecond, p.Delay(3))
+	require.Equal(t, time.Second, p.Delay(10))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(1)
+		require.GreaterOrEqual(t, d, 50*time.Millisecond)
+		require.LessOrEqual(t, d, 150*time.Millisecond)
+	}
+}
+
+func TestPolicy_Do(t *testing.T) {
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, RetryableStatuses: []int{503}}
+
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "success",
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+		{
+			name:         "retryable_status",
+			errs:         []error{&StatusError{Code: 503}, nil},
+			wantAttempts: 2,
+		},
+		{
+			name:         "not_retryable_status",
+			errs:         []error{&StatusError{Code: 400}},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "attempts_exhausted",
+			errs:         []error{errors.New("connection refused"), errors.New("connection refused"), errors.New("connection refused")},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := p.Do(context.Background(), func(ctx context.Context) error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			require.Equal(t, tt.wantAttempts, attempts)
+			require.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
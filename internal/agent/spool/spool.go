@@ -0,0 +1,188 @@
+// Пакет spool реализует дисковую очередь батчей метрик, которые агент
+// не смог отправить на сервер. Батчи хранятся в отдельных файлах и
+// отдаются на повторную отправку в порядке поступления.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileExt = ".batch"
+
+type Spool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	seq      int64
+}
+
+// New создаёт очередь в каталоге dir. maxBytes ограничивает суммарный размер
+// батчей на диске, maxAge - их возраст. Нулевое значение снимает ограничение.
+func New(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}, nil
+}
+
+type entry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Push сохраняет батч в конец очереди. Если очередь превышает ограничения,
+// самые старые батчи удаляются.
+func (s *Spool) Push(batch []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && int64(len(batch)) > s.maxBytes {
+		return errors.New("batch is larger than spool size limit")
+	}
+
+	// имя файла задаёт порядок батчей в очереди
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, fileExt)
+	tmp := filepath.Join(s.dir, name+".tmp")
+
+	if err := os.WriteFile(tmp, batch, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	_, err := s.trim()
+	return err
+}
+
+// Replay отправляет батчи из очереди по порядку с помощью send и удаляет
+// успешно отправленные. При первой ошибке отправка прекращается,
+// оставшиеся батчи остаются в очереди.
+func (s *Spool) Replay(send func(batch []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.trim()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		batch, err := os.ReadFile(e.path)
+		if err != nil {
+			return err
+		}
+
+		if err := send(batch); err != nil {
+			return err
+		}
+
+		if err := os.Remove(e.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Depth возвращает количество батчей в очереди и их суммарный размер в байтах
+func (s *Spool) Depth() (count int, size int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, e := range entries {
+		size += e.size
+	}
+
+	return len(entries), size, nil
+}
+
+// Удаляет устаревшие батчи и самые старые батчи сверх лимита размера.
+// Возвращает оставшиеся батчи в порядке поступления.
+func (s *Spool) trim() ([]entry, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	now := time.Now()
+	for len(entries) > 0 {
+		oldest := entries[0]
+		expired := s.maxAge > 0 && now.Sub(oldest.modTime) > s.maxAge
+		overflow := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !overflow {
+			break
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		total -= oldest.size
+		entries = entries[1:]
+	}
+
+	return entries, nil
+}
+
+// Список батчей в очереди, отсортированный по порядку поступления
+func (s *Spool) entries() ([]entry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []entry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileExt) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		entries = append(entries, entry{
+			path:    filepath.Join(s.dir, f.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,70 @@
+package spool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool_ReplayInOrder(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	for _, batch := range []string{"first", "second", "third"} {
+		require.NoError(t, s.Push([]byte(batch)))
+	}
+
+	// сервер принимает только первый батч
+	sent := []string{}
+	err = s.Replay(func(batch []byte) error {
+		if len(sent) == 1 {
+			return errors.New("server unavailable")
+		}
+		sent = append(sent, string(batch))
+		return nil
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{"first"}, sent)
+
+	count, _, err := s.Depth()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	err = s.Replay(func(batch []byte) error {
+		sent = append(sent, string(batch))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second", "third"}, sent)
+
+	count, size, err := s.Depth()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	require.Equal(t, int64(0), size)
+}
+
+func TestSpool_Limits(t *testing.T) {
+	s, err := New(t.TempDir(), 10, 0)
+	require.NoError(t, err)
+
+	require.Error(t, s.Push([]byte("larger than ten bytes")))
+
+	for _, batch := range []string{"aaaa", "bbbb", "cccc"} {
+		require.NoError(t, s.Push([]byte(batch)))
+	}
+
+	// самый старый батч вытеснен по размеру
+	count, size, err := s.Depth()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, int64(8), size)
+
+	s.maxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	require.NoError(t, s.Replay(func(batch []byte) error {
+		t.Fatalf("expired batch %q was replayed", batch)
+		return nil
+	}))
+}
@@ -0,0 +1,158 @@
+// Пакет encryption реализует гибридное шифрование тела запроса агента:
+// тело шифруется AES-256-GCM одноразовым ключом, а сам ключ - RSA-OAEP
+// открытым ключом сервера.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Заголовок, которым агент помечает зашифрованное тело запроса
+const (
+	Header = "X-Encryption"
+	Scheme = "rsa-oaep-aes256-gcm"
+)
+
+var ErrMalformed = errors.New("malformed encrypted message")
+
+// LoadPublicKey читает открытый ключ RSA из PEM-файла (PKIX или PKCS#1)
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+
+	return rsaKey, nil
+}
+
+// LoadPrivateKey читает закрытый ключ RSA из PEM-файла (PKCS#8 или PKCS#1)
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", path)
+	}
+
+	return rsaKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	return block, nil
+}
+
+// Encrypt шифрует сообщение. Формат результата:
+// длина зашифрованного ключа (2 байта) | зашифрованный ключ | nonce | шифротекст
+func Encrypt(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, sessionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt расшифровывает сообщение, зашифрованное Encrypt
+func Decrypt(priv *rsa.PrivateKey, message []byte) ([]byte, error) {
+	if len(message) < 2 {
+		return nil, ErrMalformed
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(message))
+	message = message[2:]
+	if len(message) < keyLen {
+		return nil, ErrMalformed
+	}
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, message[:keyLen], nil)
+	if err != nil {
+		return nil, err
+	}
+	message = message[keyLen:]
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	return gcm.Open(nil, message[:gcm.NonceSize()], message[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,52 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	privPath := filepath.Join(dir, "private.pem")
+	pubPath := filepath.Join(dir, "public.pem")
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600))
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644))
+
+	pub, err := LoadPublicKey(pubPath)
+	require.NoError(t, err)
+	loadedPriv, err := LoadPrivateKey(privPath)
+	require.NoError(t, err)
+
+	plaintext := []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`)
+	message, err := Encrypt(pub, plaintext)
+	require.NoError(t, err)
+	require.NotContains(t, string(message), "Alloc")
+
+	decrypted, err := Decrypt(loadedPriv, message)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// повреждённое сообщение не расшифровывается
+	message[len(message)-1] ^= 0xff
+	_, err = Decrypt(loadedPriv, message)
+	require.Error(t, err)
+
+	_, err = Decrypt(loadedPriv, []byte{0x01})
+	require.ErrorIs(t, err, ErrMalformed)
+}
@@ -0,0 +1,40 @@
+package proto
+
+import "github.com/region23/go-musthave-devops/internal/serializers"
+
+// ToProto переводит метрику в сообщение gRPC
+func ToProto(m serializers.Metric) *Metric {
+	return &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Hash:   m.Hash,
+		Labels: m.Labels,
+	}
+}
+
+// FromProto переводит сообщение gRPC в метрику
+func FromProto(m *Metric) serializers.Metric {
+	metric := serializers.Metric{
+		ID:    m.GetId(),
+		MType: m.GetType(),
+		Hash:  m.GetHash(),
+	}
+
+	if m.Delta != nil {
+		delta := m.GetDelta()
+		metric.Delta = &delta
+	}
+
+	if m.Value != nil {
+		value := m.GetValue()
+		metric.Value = &value
+	}
+
+	if len(m.GetLabels()) > 0 {
+		metric.Labels = m.GetLabels()
+	}
+
+	return metric
+}
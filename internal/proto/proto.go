@@ -0,0 +1,4 @@
+// Пакет proto содержит описание gRPC-сервиса метрик и сгенерированный по нему код
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
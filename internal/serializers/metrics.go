@@ -6,7 +6,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -16,23 +18,71 @@ type Gauge float64
 type Counter int64
 
 type Metric struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	ID     string            `json:"id"`               // имя метрики
+	MType  string            `json:"type"`             // параметр, принимающий значение gauge или counter
+	Delta  *int64            `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value  *float64          `json:"value,omitempty"`  // значение метрики в случае передачи gauge
+	Hash   string            `json:"hash,omitempty"`   // значение хеш-функции
+	Labels map[string]string `json:"labels,omitempty"` // метки метрики, например host или env
+}
+
+// Key возвращает идентификатор метрики: имя и отсортированный набор меток.
+// Для метрики без меток совпадает с ID.
+func (m Metric) Key() string {
+	if len(m.Labels) == 0 {
+		return m.ID
+	}
+	return m.ID + "{" + LabelsString(m.Labels) + "}"
+}
+
+// LabelsString возвращает метки в каноническом виде k1="v1",k2="v2", отсортированные по имени
+func LabelsString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// ParseLabels разбирает строку вида host=web1,env=prod в набор меток
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("неверный формат метки %q, ожидается name=value", pair)
+		}
+		labels[name] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
 }
 
 type Metrics struct {
 	collection map[string]Metric
 	key        string
+	labels     map[string]string
 	mu         sync.Mutex
 }
 
-func InitMetrics(key string) *Metrics {
+// InitMetrics создаёт коллекцию метрик. Метки labels добавляются к каждой метрике коллекции
+func InitMetrics(key string, labels map[string]string) *Metrics {
 	return &Metrics{
 		collection: make(map[string]Metric),
 		key:        key,
+		labels:     labels,
 	}
 }
 
@@ -134,29 +184,124 @@ func NewMetric(id string, mtype string, val ...interface{}) (Metric, error) {
 
 // Добавление метрики в коллекцию
 func (m *Metrics) Add(id string, mtype string, val interface{}) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.AddLabeled(id, mtype, val, nil)
+}
+
+// AddLabeled добавляет метрику с собственными метками, например mountpoint
+// или interface. Они дополняют общие метки коллекции. Метрики с одним именем,
+// но разными метками хранятся отдельно
+func (m *Metrics) AddLabeled(id string, mtype string, val interface{}, labels map[string]string) error {
 	metric, err := NewMetric(id, mtype, val)
 	if err != nil {
 		return err
 	}
 
-	if m.key != "" {
-		if metric.Value != nil {
-			metric.Hash = Hash(m.key, metric.ID, metric.MType, fmt.Sprintf("%f", *metric.Value))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(metric, labels)
+
+	return nil
+}
+
+// Inc увеличивает счётчик на delta. Значение копится до успешной отправки, см. Sent
+func (m *Metrics) Inc(id string, delta int64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := Metric{ID: id, MType: "counter"}
+	if current, exist := m.collection[collectionKey(id, labels)]; exist && current.Delta != nil {
+		delta += *current.Delta
+	}
+	metric.Delta = &delta
+
+	m.put(metric, labels)
+}
+
+// Sent вычитает из счётчиков отправленные значения, чтобы не отправить их повторно.
+// То, что накопилось после формирования батча, остаётся в коллекции
+func (m *Metrics) Sent(batch []Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := make(map[string]int64)
+	for _, metric := range batch {
+		if metric.MType == "counter" && metric.Delta != nil {
+			sent[metric.Key()] = *metric.Delta
 		}
-		if metric.Delta != nil {
-			metric.Hash = Hash(m.key, metric.ID, metric.MType, fmt.Sprintf("%d", *metric.Delta))
+	}
+
+	for key, current := range m.collection {
+		delta, ok := sent[current.Key()]
+		if !ok || current.MType != "counter" || current.Delta == nil {
+			continue
 		}
+
+		delta = *current.Delta - delta
+		current.Delta = &delta
+		m.sign(&current)
+		m.collection[key] = current
 	}
+}
 
-	m.collection[id] = metric
+// Remove удаляет метрику с собственными метками labels, например когда
+// пропал процесс, о котором она была, чтобы не отправлять её застывшее значение
+func (m *Metrics) Remove(id string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return nil
+	delete(m.collection, collectionKey(id, labels))
 }
 
-func Hash(key, id, mType, val string) string {
+// put сохраняет метрику в коллекцию, добавляя метки и хэш. Вызывается под m.mu
+func (m *Metrics) put(metric Metric, labels map[string]string) {
+	if len(m.labels) > 0 || len(labels) > 0 {
+		metric.Labels = make(map[string]string, len(m.labels)+len(labels))
+		for name, value := range m.labels {
+			metric.Labels[name] = value
+		}
+		for name, value := range labels {
+			metric.Labels[name] = value
+		}
+	}
+
+	m.sign(&metric)
+	m.collection[collectionKey(metric.ID, labels)] = metric
+}
+
+func (m *Metrics) sign(metric *Metric) {
+	if m.key == "" {
+		return
+	}
+
+	if metric.Value != nil {
+		metric.Hash = Hash(m.key, metric.ID, metric.MType, fmt.Sprintf("%f", *metric.Value), metric.Labels)
+	}
+	if metric.Delta != nil {
+		metric.Hash = Hash(m.key, metric.ID, metric.MType, fmt.Sprintf("%d", *metric.Delta), metric.Labels)
+	}
+}
+
+// Общие метки у всех метрик коллекции одинаковые, поэтому ключ строится
+// только по собственным меткам. Для метрики без них совпадает с id
+func collectionKey(id string, labels map[string]string) string {
+	return Metric{ID: id, Labels: labels}.Key()
+}
+
+// Sign возвращает HMAC-SHA256 тела запроса или ответа в hex, как в заголовке HashSHA256
+func Sign(key string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash считает HMAC-SHA256 от строки id:type:value. Если у метрики есть метки,
+// то к строке добавляется :labels в каноническом виде
+func Hash(key, id, mType, val string, labels map[string]string) string {
 	str := fmt.Sprintf("%s:%s:%s", id, mType, val)
+	if len(labels) > 0 {
+		str += ":" + LabelsString(labels)
+	}
 	h := hmac.New(sha256.New, []byte(key))
 	h.Write([]byte(str))
 	return hex.EncodeToString(h.Sum(nil))
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/region23/go-musthave-devops/internal/proto"
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	mw "github.com/region23/go-musthave-devops/internal/server/middleware"
+	"github.com/region23/go-musthave-devops/internal/tlsconfig"
+)
+
+// gRPC-сервис метрик. Использует то же хранилище и те же проверки, что и HTTP-ручки
+type GRPCServer struct {
+	pb.UnimplementedMetricsServer
+	server *Server
+}
+
+func NewGRPCServer(s *Server) *GRPCServer {
+	return &GRPCServer{server: s}
+}
+
+// Обновление одной метрики
+func (g *GRPCServer) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "metric is empty")
+	}
+
+	err := g.server.saveMetrics(ctx, []serializers.Metric{pb.FromProto(req.GetMetric())})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pb.UpdateResponse{}, nil
+}
+
+// Обновление пачки метрик
+func (g *GRPCServer) Updates(ctx context.Context, req *pb.UpdatesRequest) (*pb.UpdatesResponse, error) {
+	if err := g.saveBatch(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdatesResponse{}, nil
+}
+
+// Поток пачек метрик. Ответ отправляется после того, как клиент закроет поток
+func (g *GRPCServer) Stream(stream pb.Metrics_StreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.UpdatesResponse{})
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := g.saveBatch(stream.Context(), req); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *GRPCServer) saveBatch(ctx context.Context, req *pb.UpdatesRequest) error {
+	if len(req.GetMetrics()) == 0 {
+		return status.Error(codes.InvalidArgument, "batch is empty")
+	}
+
+	metrics := make([]serializers.Metric, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		metrics = append(metrics, pb.FromProto(m))
+	}
+
+	if err := g.server.saveMetrics(ctx, metrics); err != nil {
+		return grpcError(err)
+	}
+
+	return nil
+}
+
+// Перехватчик unary-вызовов: пропускает только агентов из доверенных подсетей
+func (g *GRPCServer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := g.checkSubnet(ctx); err != nil {
+		return nil, err
+	}
+	return handler(withPeerIdentity(ctx), req)
+}
+
+// Перехватчик потоковых вызовов: пропускает только агентов из доверенных подсетей
+func (g *GRPCServer) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.checkSubnet(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, &identityStream{ServerStream: ss, ctx: withPeerIdentity(ss.Context())})
+}
+
+// Поток с контекстом, в который добавлено имя агента
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// Кладём в контекст имя агента из клиентского TLS-сертификата или метаданных
+// x-agent-id, как это делает mw.AgentIdentity
+func withPeerIdentity(ctx context.Context) context.Context {
+	var identity string
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			identity = tlsconfig.Identity(&tlsInfo.State)
+		}
+	}
+
+	if identity == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(strings.ToLower(mw.AgentIDHeader)); len(values) > 0 {
+				identity = values[0]
+			}
+		}
+	}
+
+	if identity != "" {
+		return mw.WithAgentIdentity(ctx, identity)
+	}
+	return ctx
+}
+
+// Адрес агента берём из адреса соединения, а за доверенным прокси - из метаданных x-real-ip
+func (g *GRPCServer) checkSubnet(ctx context.Context) error {
+	subnets := g.server.TrustedSubnets
+	if len(subnets) == 0 {
+		return nil
+	}
+
+	var header, remoteAddr string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(mw.RealIPHeader)); len(values) > 0 {
+			header = values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	ip := mw.ClientIP(header, remoteAddr, g.server.TrustedProxies)
+	if ip == nil || !mw.InSubnets(subnets, ip) {
+		return status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	return nil
+}
+
+// gRPC-статус для ошибки сохранения метрики
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrUnsupportedType):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, ErrUnknownAgent):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrStorage):
+		return status.Error(codes.Internal, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case storageUnavailable(err):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
@@ -0,0 +1,143 @@
+// Package keys хранит ключи подписи метрик для каждого агента.
+//
+// Реестр читается из JSON-файла вида
+//
+//	{
+//	  "web-1": [
+//	    {"key": "new-secret"},
+//	    {"key": "old-secret", "expires_at": "2026-11-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// У агента может быть несколько ключей: на время ротации сервер принимает
+// подпись любым ключом, срок действия которого не истёк.
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// UnknownAgent - имя, под которым учитываются отклонённые метрики агентов,
+// которых нет в реестре. Идентификатор агента ничем не подтверждён, и отдельный
+// счётчик на каждое присланное имя позволил бы раздувать память и /metrics.
+// Пустого имени в файле ключей быть не может, поэтому оно ни с кем не совпадёт
+const UnknownAgent = ""
+
+// Key - ключ агента. Пустой ExpiresAt означает бессрочный ключ
+type Key struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Активен ли ключ в момент now
+func (k Key) Active(now time.Time) bool {
+	return k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt)
+}
+
+// Registry - потокобезопасный реестр ключей агентов с подсчётом отклонённых метрик
+type Registry struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string][]Key
+
+	rejectionsMu sync.Mutex
+	rejections   map[string]uint64
+
+	// текущее время, подменяется в тестах
+	now func() time.Time
+}
+
+// Load читает реестр из файла
+func Load(path string) (*Registry, error) {
+	r := &Registry{
+		path:       path,
+		rejections: make(map[string]uint64),
+		now:        time.Now,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload перечитывает файл. При ошибке остаются прежние ключи
+func (r *Registry) Reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string][]Key)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("ошибка разбора файла ключей %s: %w", r.path, err)
+	}
+
+	for agent, agentKeys := range keys {
+		if agent == "" {
+			return errors.New("пустой идентификатор агента в файле ключей")
+		}
+		for _, key := range agentKeys {
+			if key.Key == "" {
+				return fmt.Errorf("пустой ключ у агента %q", agent)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Keys возвращает действующие ключи агента в порядке из файла.
+// known=false, если агента нет в реестре
+func (r *Registry) Keys(agent string) (keys []string, known bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	agentKeys, known := r.keys[agent]
+	now := r.now()
+	for _, key := range agentKeys {
+		if key.Active(now) {
+			keys = append(keys, key.Key)
+		}
+	}
+
+	return keys, known
+}
+
+// Reject увеличивает счётчик отклонённых метрик агента.
+// Агенты не из реестра учитываются вместе, под UnknownAgent
+func (r *Registry) Reject(agent string) {
+	r.mu.RLock()
+	if _, known := r.keys[agent]; !known {
+		agent = UnknownAgent
+	}
+	r.mu.RUnlock()
+
+	r.rejectionsMu.Lock()
+	r.rejections[agent]++
+	r.rejectionsMu.Unlock()
+}
+
+// Rejections возвращает копию счётчиков отклонённых метрик по агентам
+func (r *Registry) Rejections() map[string]uint64 {
+	r.rejectionsMu.Lock()
+	defer r.rejectionsMu.Unlock()
+
+	rejections := make(map[string]uint64, len(r.rejections))
+	for agent, count := range r.rejections {
+		rejections[agent] = count
+	}
+
+	return rejections
+}
@@ -0,0 +1,73 @@
+package keys
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"web-1": [
+			{"key": "new"},
+			{"key": "old", "expires_at": "2026-11-01T00:00:00Z"}
+		],
+		"web-2": [{"key": "expired", "expires_at": "2026-01-01T00:00:00Z"}]
+	}`), 0600))
+
+	registry, err := Load(path)
+	require.NoError(t, err)
+	registry.now = func() time.Time { return time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) }
+
+	keys, known := registry.Keys("web-1")
+	require.True(t, known)
+	require.Equal(t, []string{"new", "old"}, keys)
+
+	keys, known = registry.Keys("web-2")
+	require.True(t, known)
+	require.Empty(t, keys)
+
+	_, known = registry.Keys("web-3")
+	require.False(t, known)
+
+	// после окончания окна ротации старый ключ больше не принимается
+	registry.now = func() time.Time { return time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC) }
+	keys, _ = registry.Keys("web-1")
+	require.Equal(t, []string{"new"}, keys)
+
+	// ошибочный файл не затирает прежние ключи
+	require.NoError(t, os.WriteFile(path, []byte(`{"web-1": [{"key": ""}]}`), 0600))
+	require.Error(t, registry.Reload())
+	keys, _ = registry.Keys("web-1")
+	require.Equal(t, []string{"new"}, keys)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"web-3": [{"key": "third"}]}`), 0600))
+	require.NoError(t, registry.Reload())
+	_, known = registry.Keys("web-1")
+	require.False(t, known)
+	keys, _ = registry.Keys("web-3")
+	require.Equal(t, []string{"third"}, keys)
+
+	// web-1 уже нет в реестре, он учитывается вместе с неизвестными
+	registry.Reject("web-3")
+	registry.Reject("web-1")
+	registry.Reject("random-1")
+	registry.Reject("")
+	require.Equal(t, map[string]uint64{"web-3": 1, UnknownAgent: 3}, registry.Rejections())
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := Load(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`not json`), 0600))
+	_, err = Load(path)
+	require.Error(t, err)
+}
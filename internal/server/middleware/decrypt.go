@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/region23/go-musthave-devops/internal/encryption"
+)
+
+// MaxEncryptedBody - наибольший размер зашифрованного тела запроса. Тело читается
+// в память целиком, поэтому без ограничения один запрос может занять всю память
+const MaxEncryptedBody = 32 << 20
+
+// Decrypt расшифровывает тело запросов, помеченных заголовком encryption.Header,
+// закрытым ключом сервера. Если ключ не задан, такие запросы отклоняются.
+func Decrypt(key *rsa.PrivateKey) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(encryption.Header)
+			if scheme == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if key == nil || scheme != encryption.Scheme {
+				http.Error(w, "unsupported encryption", http.StatusBadRequest)
+				return
+			}
+
+			message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxEncryptedBody))
+			if err != nil {
+				status := http.StatusBadRequest
+				// MaxBytesReader отдаёт ровно MaxEncryptedBody байт и ошибку
+				if len(message) == MaxEncryptedBody {
+					status = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			body, err := encryption.Decrypt(key, message)
+			if err != nil {
+				http.Error(w, "can't decrypt request body", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del(encryption.Header)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
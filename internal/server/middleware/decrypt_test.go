@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/encryption"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	plaintext := []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`)
+	message, err := encryption.Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	foreign, err := encryption.Encrypt(&otherKey.PublicKey, plaintext)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		key        *rsa.PrivateKey
+		scheme     string
+		body       []byte
+		wantStatus int
+		wantBody   []byte
+	}{
+		{
+			name:       "round_trip",
+			key:        key,
+			scheme:     encryption.Scheme,
+			body:       message,
+			wantStatus: http.StatusOK,
+			wantBody:   plaintext,
+		},
+		{
+			name:       "plain_request",
+			key:        key,
+			body:       plaintext,
+			wantStatus: http.StatusOK,
+			wantBody:   plaintext,
+		},
+		{
+			name:       "wrong_key",
+			key:        key,
+			scheme:     encryption.Scheme,
+			body:       foreign,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bad_ciphertext",
+			key:        key,
+			scheme:     encryption.Scheme,
+			body:       append(append([]byte{}, message[:len(message)-1]...), message[len(message)-1]^0xff),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no_server_key",
+			scheme:     encryption.Scheme,
+			body:       message,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown_scheme",
+			key:        key,
+			scheme:     "rot13",
+			body:       message,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too_large",
+			key:        key,
+			scheme:     encryption.Scheme,
+			body:       make([]byte, MaxEncryptedBody+1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			handler := Decrypt(tt.key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Empty(t, r.Header.Get(encryption.Header))
+				got, _ = io.ReadAll(r.Body)
+			}))
+
+			request := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(tt.body))
+			if tt.scheme != "" {
+				request.Header.Set(encryption.Header, tt.scheme)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			require.Equal(t, tt.wantStatus, response.Code)
+			require.Equal(t, tt.wantBody, got)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/region23/go-musthave-devops/internal/tlsconfig"
+)
+
+// Заголовок, в котором агент передаёт свой идентификатор
+const AgentIDHeader = "X-Agent-ID"
+
+type agentIdentityKey struct{}
+
+// AgentIdentity кладёт в контекст запроса имя агента. Имя из клиентского
+// TLS-сертификата важнее заголовка X-Agent-ID, так как оно проверено
+func AgentIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := tlsconfig.Identity(r.TLS)
+		if identity == "" {
+			identity = r.Header.Get(AgentIDHeader)
+		}
+		if identity != "" {
+			r = r.WithContext(WithAgentIdentity(r.Context(), identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WithAgentIdentity возвращает контекст с именем агента
+func WithAgentIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, agentIdentityKey{}, identity)
+}
+
+// AgentIdentityFrom возвращает имя агента из контекста или пустую строку,
+// если агент не предъявил ни клиентский сертификат, ни заголовок X-Agent-ID
+func AgentIdentityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(agentIdentityKey{}).(string)
+	return identity
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+)
+
+// Заголовок с HMAC-SHA256 тела запроса или ответа в hex
+const SignatureHeader = "HashSHA256"
+
+// MaxSignedBody - наибольший размер подписанного тела запроса. Для проверки
+// подписи тело читается в память целиком
+const MaxSignedBody = 32 << 20
+
+type signedKey struct{}
+
+// SignatureKeys возвращает ключи, которыми может быть подписан запрос агента
+// из контекста. Первый ключ используется для подписи ответа.
+type SignatureKeys func(ctx context.Context) ([]string, error)
+
+// Signature сверяет заголовок HashSHA256 с телом запроса в том виде, в каком
+// оно пришло по сети, и подписывает ответ первым ключом агента. Запросы без
+// заголовка пропускаются: их метрики проверяются по старым хэшам каждой метрики.
+// reject вызывается для каждой отклонённой подписи.
+func Signature(keys SignatureKeys, reject func(ctx context.Context)) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agentKeys, err := keys(r.Context())
+
+			if signature := r.Header.Get(SignatureHeader); signature != "" {
+				switch {
+				case err != nil:
+					reject(r.Context())
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				case len(agentKeys) == 0:
+					// у сервера нет ключей, проверять подпись нечем
+				default:
+					body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxSignedBody))
+					if err != nil {
+						status := http.StatusBadRequest
+						// MaxBytesReader отдаёт ровно MaxSignedBody байт и ошибку
+						if len(body) == MaxSignedBody {
+							status = http.StatusRequestEntityTooLarge
+						}
+						http.Error(w, err.Error(), status)
+						return
+					}
+
+					if !validSignature(agentKeys, body, signature) {
+						reject(r.Context())
+						http.Error(w, "signature is not valid", http.StatusBadRequest)
+						return
+					}
+
+					r.Body = io.NopCloser(bytes.NewReader(body))
+					r = r.WithContext(context.WithValue(r.Context(), signedKey{}, true))
+				}
+			}
+
+			if len(agentKeys) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sw := &signatureWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			body := sw.body.Bytes()
+			w.Header().Set(SignatureHeader, serializers.Sign(agentKeys[0], body))
+			w.WriteHeader(sw.status)
+			w.Write(body)
+		})
+	}
+}
+
+// SignedFrom сообщает, что подпись тела запроса уже проверена
+func SignedFrom(ctx context.Context) bool {
+	signed, _ := ctx.Value(signedKey{}).(bool)
+	return signed
+}
+
+func validSignature(keys []string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	for _, key := range keys {
+		want, _ := hex.DecodeString(serializers.Sign(key, body))
+		if hmac.Equal(got, want) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Копит тело ответа, чтобы подписать его целиком перед отправкой
+type signatureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signatureWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *signatureWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Заголовок с адресом агента. Ему верим, только если запрос пришёл
+// от доверенного прокси - иначе любой может подставить адрес из доверенной подсети
+const RealIPHeader = "X-Real-IP"
+
+// ParseSubnets разбирает список подсетей в формате CIDR через запятую
+func ParseSubnets(s string) ([]*net.IPNet, error) {
+	subnets := []*net.IPNet{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("неверная подсеть %q: %w", item, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+// InSubnets проверяет, входит ли адрес в одну из подсетей
+func InSubnets(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP возвращает адрес, с которого пришёл запрос. Если это доверенный прокси
+// из proxies, то адрес агента берётся из заголовка X-Real-IP
+func ClientIP(header, remoteAddr string, proxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	peer := net.ParseIP(host)
+
+	if header != "" && peer != nil && InSubnets(proxies, peer) {
+		return net.ParseIP(strings.TrimSpace(header))
+	}
+	return peer
+}
+
+// TrustedSubnet пропускает только запросы из доверенных подсетей, остальным отвечает 403.
+// Пустой список подсетей ничего не ограничивает. proxies - адреса доверенных прокси,
+// за которыми адрес агента берётся из X-Real-IP
+func TrustedSubnet(subnets, proxies []*net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(subnets) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip := ClientIP(r.Header.Get(RealIPHeader), r.RemoteAddr, proxies)
+			if ip == nil || !InSubnets(subnets, ip) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
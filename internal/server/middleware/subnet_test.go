@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseSubnets("10.1.0.0/16")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "remote_addr",
+			remoteAddr: "192.168.1.9:5555",
+			want:       "192.168.1.9",
+		},
+		{
+			name:       "spoofed_header_from_untrusted_peer",
+			header:     "10.0.0.5",
+			remoteAddr: "192.168.1.9:5555",
+			want:       "192.168.1.9",
+		},
+		{
+			name:       "header_from_trusted_proxy",
+			header:     "10.0.0.5",
+			remoteAddr: "10.1.2.3:5555",
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "proxy_without_header",
+			remoteAddr: "10.1.2.3:5555",
+			want:       "10.1.2.3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, net.ParseIP(tt.want), ClientIP(tt.header, tt.remoteAddr, proxies))
+		})
+	}
+
+	require.Nil(t, ClientIP("10.0.0.5", "bufconn", proxies))
+}
@@ -1,17 +1,24 @@
 package server
 
 import (
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server/keys"
 	mw "github.com/region23/go-musthave-devops/internal/server/middleware"
 	"github.com/region23/go-musthave-devops/internal/server/storage"
 	"github.com/region23/go-musthave-devops/internal/server/storage/database"
@@ -22,6 +29,20 @@ type Server struct {
 	Router  *chi.Mux
 	Key     string
 	DBPool  *pgxpool.Pool
+	// Закрытый ключ для расшифровки тела запросов агента, может быть nil
+	PrivateKey *rsa.PrivateKey
+	// Подсети, из которых разрешено отправлять метрики. Пустой список - без ограничений
+	TrustedSubnets []*net.IPNet
+	// Подсети, из которых разрешено читать метрики. Пустой список - без ограничений
+	TrustedReadSubnets []*net.IPNet
+	// Адреса прокси, которым разрешено передавать адрес агента в X-Real-IP.
+	// От остальных заголовок игнорируется и проверяется адрес соединения
+	TrustedProxies []*net.IPNet
+	// Ключи подписи отдельных агентов, может быть nil. Агенты, которых нет
+	// в реестре, подписывают метрики общим ключом Key
+	Keys *keys.Registry
+	// Предельное время одного обращения к хранилищу. Ноль - без ограничения
+	StorageTimeout time.Duration
 }
 
 func New(storage storage.Repository, key string, dbpool *pgxpool.Pool) *Server {
@@ -37,16 +58,31 @@ func (s *Server) MountHandlers() {
 	// Mount all Middleware here
 	s.Router.Use(middleware.Logger)
 	s.Router.Use(middleware.StripSlashes)
+	s.Router.Use(mw.AgentIdentity)
+	// тело сначала расшифровываем, затем распаковываем
+	body := []func(http.Handler) http.Handler{mw.Decrypt(s.PrivateKey), mw.GZipHandle}
 	//s.Router.Use(middleware.Compress(5))
-	s.Router.Use(mw.GZipHandle)
 	// Mount all handlers here
-	s.Router.Get("/", s.AllMetrics)
-	s.Router.Post("/updates", s.UpdateBatchMetricsJSON)
-	s.Router.Post("/update", s.UpdateMetricJSON)
-	s.Router.Post("/update/{metricType}/{metricName}/{metricValue}", s.UpdateMetric)
-	s.Router.Post("/value", s.GetMetricJSON)
-	s.Router.Get("/value/{metricType}/{metricName}", s.GetMetric)
-	s.Router.Get("/ping", s.Ping)
+	s.Router.Group(func(r chi.Router) {
+		r.Use(mw.TrustedSubnet(s.TrustedSubnets, s.TrustedProxies))
+		// подпись считается по телу в том виде, в каком оно пришло и уйдёт по сети,
+		// и только у запросов из доверенных подсетей
+		r.Use(mw.Signature(s.agentKeys, s.reject))
+		r.Use(body...)
+		r.Post("/updates", s.UpdateBatchMetricsJSON)
+		r.Post("/update", s.UpdateMetricJSON)
+		r.Post("/update/{metricType}/{metricName}/{metricValue}", s.UpdateMetric)
+	})
+	s.Router.Group(func(r chi.Router) {
+		r.Use(mw.TrustedSubnet(s.TrustedReadSubnets, s.TrustedProxies))
+		r.Use(body...)
+		r.Get("/", s.AllMetrics)
+		r.Post("/value", s.GetMetricJSON)
+		r.Get("/value/{metricType}/{metricName}", s.GetMetric)
+		r.Get("/history/{metricType}/{metricName}", s.MetricHistory)
+		r.Get("/metrics", s.PrometheusMetrics)
+	})
+	s.Router.With(body...).Get("/ping", s.Ping)
 
 }
 
@@ -87,9 +123,11 @@ func (s *Server) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// write metric to repository
-	err = s.storage.Put(metric)
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	err = s.storage.Put(ctx, metric)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Ошибка при сохранении метрики: %v", err.Error()), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Ошибка при сохранении метрики: %v", err.Error()), errorStatus(storageError(err)))
 		return
 	}
 
@@ -115,31 +153,15 @@ func (s *Server) UpdateBatchMetricsJSON(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	for _, metric := range metrics {
-		if metric.Value == nil && metric.Delta == nil {
-			JSONError(w, "Value can't be nil", http.StatusBadRequest)
-			return
-		}
-
-		if metric.MType != "gauge" && metric.MType != "counter" {
-			JSONError(w, "Не поддерживаемый тип метрики", http.StatusNotImplemented)
-			return
-		}
-
-		// Если хэш не пустой, то сверяем хэши
-		_, err := checkHash(s.Key, &metric, w)
-		if err != nil {
-			JSONError(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		// write metric to repository
-		err = s.storage.Put(metric)
-		if err != nil {
-			JSONError(w, fmt.Sprintf("Ошибка при сохранении метрики: %v", err.Error()), http.StatusBadRequest)
-			return
+	err = s.saveMetrics(r.Context(), metrics)
+	if err != nil {
+		uResp := UserResponse{Error: err.Error()}
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			uResp.Errors = batchErr.Items
 		}
-
+		writeJSON(w, uResp, errorStatus(err))
+		return
 	}
 
 	// response answer
@@ -161,32 +183,9 @@ func (s *Server) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if metric.MType != "gauge" && metric.MType != "counter" {
-		JSONError(w, "Не поддерживаемый тип метрики", http.StatusNotImplemented)
-		return
-	}
-
-	if metric.ID == "" {
-		JSONError(w, "Metric name can't be empty", http.StatusNotFound)
-		return
-	}
-
-	if metric.Value == nil && metric.Delta == nil {
-		JSONError(w, "Value can't be nil", http.StatusBadRequest)
-		return
-	}
-
-	// Если хэш не пустой, то сверяем хэши
-	_, err = checkHash(s.Key, &metric, w)
-	if err != nil {
-		JSONError(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// write metric to repository
-	err = s.storage.Put(metric)
+	err = s.saveMetrics(r.Context(), []serializers.Metric{metric})
 	if err != nil {
-		JSONError(w, fmt.Sprintf("Ошибка при сохранении метрики: %v", err.Error()), http.StatusBadRequest)
+		JSONError(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -204,12 +203,18 @@ func (s *Server) UpdateMetricJSON(w http.ResponseWriter, r *http.Request) {
 
 // Ручка возвращающая значение метрики
 func (s *Server) GetMetric(w http.ResponseWriter, r *http.Request) {
-	metricName := chi.URLParam(r, "metricName")
+	metricKey, err := urlMetricKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	metric, err := s.storage.Get(metricName)
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	metric, err := s.storage.Get(ctx, metricKey)
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Ошибка при получении метрики: %v", err.Error()), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Ошибка при получении метрики: %v", err.Error()), storageStatus(err, http.StatusNotFound))
 		return
 	}
 
@@ -232,10 +237,12 @@ func (s *Server) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	metric, err = s.storage.Get(metric.ID)
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	metric, err = s.storage.Get(ctx, metric.Key())
 
 	if err != nil {
-		JSONError(w, fmt.Sprintf("Ошибка при получении метрики: %v", err.Error()), http.StatusNotFound)
+		JSONError(w, fmt.Sprintf("Ошибка при получении метрики: %v", err.Error()), storageStatus(err, http.StatusNotFound))
 		return
 	}
 
@@ -244,12 +251,10 @@ func (s *Server) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Если хэш не пустой, то сверяем хэши
-	metric.Hash, err = checkHash(s.Key, metric, w)
-	if err != nil {
-		JSONError(w, err.Error(), http.StatusNotFound)
-		return
-	}
+	// Сохранённый хэш мог быть сделан ключом агента, а не сервера,
+	// поэтому подписываем значение заново ключом сервера
+	metric.Hash = ""
+	metric.Hash, _ = checkHash(serverKeys(s.Key), metric)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -260,6 +265,81 @@ func (s *Server) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Ручка возвращающая историю значений метрики за период ?from=&to=
+func (s *Server) MetricHistory(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "metricType")
+
+	if metricType != "gauge" && metricType != "counter" {
+		JSONError(w, "Не поддерживаемый тип метрики", http.StatusNotImplemented)
+		return
+	}
+
+	metricKey, err := urlMetricKey(r)
+	if err != nil {
+		JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, err := parseTime(r.URL.Query().Get("from"))
+	if err != nil {
+		JSONError(w, fmt.Sprintf("Неверное значение параметра from: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"))
+	if err != nil {
+		JSONError(w, fmt.Sprintf("Неверное значение параметра to: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	metric, err := s.storage.Get(ctx, metricKey)
+	if err != nil {
+		JSONError(w, fmt.Sprintf("Ошибка при получении метрики: %v", err.Error()), storageStatus(err, http.StatusNotFound))
+		return
+	}
+
+	if metric.MType != metricType {
+		JSONError(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+
+	samples, err := s.storage.History(ctx, metricKey, from, to)
+	if err != nil {
+		JSONError(w, fmt.Sprintf("Ошибка при получении истории метрики: %v", err.Error()), storageStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(samples)
+}
+
+// Ключ метрики из URL: имя из пути и метки из параметра ?labels=host=web1,env=prod
+func urlMetricKey(r *http.Request) (string, error) {
+	labels, err := serializers.ParseLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		return "", err
+	}
+
+	metric := serializers.Metric{ID: chi.URLParam(r, "metricName"), Labels: labels}
+	return metric.Key(), nil
+}
+
+// Разбирает время в формате RFC3339 или unix-время в секундах. Пустая строка - нулевое время
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
 // Ручка возвращающая все имеющиеся метрики и их значения в виде HTML-страницы
 func (s *Server) AllMetrics(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("templates/index.go.html")
@@ -268,22 +348,146 @@ func (s *Server) AllMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	metrics, err := s.storage.All(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка при получении метрик: %v", err.Error()), storageStatus(err, http.StatusInternalServerError))
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	metrics, err := s.storage.All()
+	tmpl.Execute(w, metrics)
+}
+
+// Ручка отдающая все метрики в текстовом формате Prometheus
+func (s *Server) PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	metrics, err := s.storage.All(ctx)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Ошибка при получении метрик: %v", err.Error()), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Ошибка при получении метрик: %v", err.Error()), storageStatus(err, http.StatusInternalServerError))
+		return
 	}
 
-	tmpl.Execute(w, metrics)
+	// сортируем по имени в Prometheus, чтобы серии одной метрики шли подряд
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		nameI, nameJ := prometheusName(metrics[keys[i]].ID), prometheusName(metrics[keys[j]].ID)
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+		return keys[i] < keys[j]
+	})
+
+	var b strings.Builder
+	types := make(map[string]string)
+	series := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		metric := metrics[key]
+		name := prometheusName(metric.ID)
+
+		var value string
+		switch {
+		case metric.MType == "counter" && metric.Delta != nil:
+			value = strconv.FormatInt(*metric.Delta, 10)
+		case metric.MType == "gauge" && metric.Value != nil:
+			value = strconv.FormatFloat(*metric.Value, 'g', -1, 64)
+		default:
+			continue
+		}
+
+		// после замены символов разные метрики могут получить одно имя,
+		// Prometheus не допускает дублей серий и разных типов под одним именем
+		mType, seen := types[name]
+		if seen && mType != metric.MType {
+			continue
+		}
+		labels := prometheusLabels(metric.Labels)
+		if series[name+labels] {
+			continue
+		}
+		series[name+labels] = true
+
+		if !seen {
+			types[name] = metric.MType
+			fmt.Fprintf(&b, "# HELP %s %s %s metric.\n", name, metric.ID, metric.MType)
+			fmt.Fprintf(&b, "# TYPE %s %s\n", name, metric.MType)
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", name, labels, value)
+	}
+
+	if s.Keys != nil {
+		writeRejections(&b, s.Keys.Rejections())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// Имя собственной метрики сервера со счётчиками отклонённых подписей
+const rejectionsMetric = "server_hash_rejections_total"
+
+// Приводит ID метрики к допустимому в Prometheus имени [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(id string) string {
+	var b strings.Builder
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	if b.Len() == 0 {
+		return "_"
+	}
+
+	return b.String()
+}
+
+// Формирует набор меток в формате Prometheus {name="value",...}
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		// в именах меток двоеточие не допускается
+		labelName := strings.ReplaceAll(prometheusName(name), ":", "_")
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escaper.Replace(labels[name])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
 }
 
 // Проверяем соединение с базой данных
 func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
-	err := database.Ping(s.DBPool)
+	ctx, cancel := s.storageContext(r.Context())
+	defer cancel()
+	err := database.Ping(ctx, s.DBPool)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), storageStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -292,35 +496,100 @@ func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Ping OK"))
 }
 
-// Сверяем хэши, а если пустой, то генерим новый
-func checkHash(key string, metric *serializers.Metric, w http.ResponseWriter) (hash string, err error) {
-	if key != "" {
-		var serverGeneratedHash string
+// Контекст обращения к хранилищу, ограниченный StorageTimeout. Отменяется
+// и при разрыве соединения с клиентом, так как наследует контекст запроса
+func (s *Server) storageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.StorageTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.StorageTimeout)
+}
 
-		if metric.Value != nil {
-			serverGeneratedHash = serializers.Hash(key, metric.ID, metric.MType, fmt.Sprintf("%f", *metric.Value))
-		}
-		if metric.Delta != nil {
-			serverGeneratedHash = serializers.Hash(key, metric.ID, metric.MType, fmt.Sprintf("%d", *metric.Delta))
-		}
+// Хранилище не ответило вовремя или недоступно
+func storageUnavailable(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, storage.ErrUnavailable)
+}
+
+// HTTP-статус для ошибки хранилища: 504, если не дождались ответа,
+// 503, если хранилище недоступно, иначе status
+func storageStatus(err error, status int) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case storageUnavailable(err):
+		return http.StatusServiceUnavailable
+	default:
+		return status
+	}
+}
+
+// Сверяем хэш с каждым из ключей, а если он пустой, то генерим новый первым ключом
+func checkHash(keys []string, metric *serializers.Metric) (hash string, err error) {
+	if len(keys) == 0 {
+		return "", nil
+	}
 
-		if metric.Hash != "" && metric.Hash != "none" && metric.Hash != serverGeneratedHash {
-			return "", errors.New("hash is not valid")
+	var value string
+	if metric.Value != nil {
+		value = fmt.Sprintf("%f", *metric.Value)
+	}
+	if metric.Delta != nil {
+		value = fmt.Sprintf("%d", *metric.Delta)
+	}
+
+	if metric.Hash == "" || metric.Hash == "none" {
+		return serializers.Hash(keys[0], metric.ID, metric.MType, value, metric.Labels), nil
+	}
+
+	for _, key := range keys {
+		serverGeneratedHash := serializers.Hash(key, metric.ID, metric.MType, value, metric.Labels)
+		if metric.Hash == serverGeneratedHash {
+			return serverGeneratedHash, nil
 		}
+	}
+
+	return "", ErrInvalidHash
+}
 
-		return serverGeneratedHash, nil
+// Список из общего ключа сервера или пустой список, если ключ не задан
+func serverKeys(key string) []string {
+	if key == "" {
+		return nil
 	}
+	return []string{key}
+}
 
-	return "", nil
+// Счётчики метрик, отклонённых из-за подписи, по агентам
+func writeRejections(b *strings.Builder, rejections map[string]uint64) {
+	if len(rejections) == 0 {
+		return
+	}
+
+	agents := make([]string, 0, len(rejections))
+	for agent := range rejections {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+
+	fmt.Fprintf(b, "# HELP %s Requests rejected because of invalid signature.\n", rejectionsMetric)
+	fmt.Fprintf(b, "# TYPE %s counter\n", rejectionsMetric)
+	for _, agent := range agents {
+		fmt.Fprintf(b, "%s%s %d\n", rejectionsMetric, prometheusLabels(map[string]string{"agent": agent}), rejections[agent])
+	}
 }
 
 type UserResponse struct {
 	Success string `json:"success,omitempty"`
 	Error   string `json:"error,omitempty"`
+	// Ошибки отдельных метрик отклонённой пачки
+	Errors []ItemError `json:"errors,omitempty"`
 }
 
 func JSONError(w http.ResponseWriter, err string, code int) {
-	uResp := UserResponse{Error: err}
+	writeJSON(w, UserResponse{Error: err}, code)
+}
+
+func writeJSON(w http.ResponseWriter, uResp UserResponse, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
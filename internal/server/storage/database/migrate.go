@@ -0,0 +1,241 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Номер advisory-блокировки, под которой применяются миграции, чтобы
+// несколько экземпляров сервера не мигрировали базу одновременно
+const migrationLock = 7243915
+
+// Migration - версия схемы со скриптами применения и отката
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState - миграция и время её применения. Nil AppliedAt - миграция не применена
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Имя файла миграции: 0001_create_metrics.up.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrations возвращает встроенные миграции в порядке версий
+func Migrations() ([]Migration, error) {
+	dir, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return loadMigrations(dir)
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("неверное имя файла миграции %s", entry.Name())
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		script, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("у миграции %d разные имена: %s и %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(script)
+		} else {
+			migration.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("у миграции %d нет скрипта up или down", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateUp применяет все неприменённые миграции, каждую в своей транзакции.
+// Возвращает применённые миграции
+func MigrateUp(ctx context.Context, dbpool *pgxpool.Pool) ([]Migration, error) {
+	var applied []Migration
+	err := withMigrationLock(ctx, dbpool, func(conn *pgxpool.Conn, states []MigrationState) error {
+		for _, state := range states {
+			if state.AppliedAt != nil {
+				continue
+			}
+
+			err := runMigration(ctx, conn, state.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, state.Version, state.Name)
+			if err != nil {
+				return fmt.Errorf("миграция %d_%s: %w", state.Version, state.Name, err)
+			}
+
+			log.Info().Msgf("Применена миграция %d_%s", state.Version, state.Name)
+			applied = append(applied, state.Migration)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown откатывает последнюю применённую миграцию.
+// Возвращает nil, если откатывать нечего
+func MigrateDown(ctx context.Context, dbpool *pgxpool.Pool) (*Migration, error) {
+	var reverted *Migration
+	err := withMigrationLock(ctx, dbpool, func(conn *pgxpool.Conn, states []MigrationState) error {
+		for i := len(states) - 1; i >= 0; i-- {
+			state := states[i]
+			if state.AppliedAt == nil {
+				continue
+			}
+
+			err := runMigration(ctx, conn, state.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, state.Version)
+			if err != nil {
+				return fmt.Errorf("откат миграции %d_%s: %w", state.Version, state.Name, err)
+			}
+
+			log.Info().Msgf("Откачена миграция %d_%s", state.Version, state.Name)
+			reverted = &state.Migration
+			return nil
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// MigrationStatus возвращает все известные миграции с отметкой о применении
+func MigrationStatus(ctx context.Context, dbpool *pgxpool.Pool) ([]MigrationState, error) {
+	var result []MigrationState
+	err := withMigrationLock(ctx, dbpool, func(conn *pgxpool.Conn, states []MigrationState) error {
+		result = states
+		return nil
+	})
+
+	return result, err
+}
+
+// Выполняет fn на одном соединении под advisory-блокировкой, передавая состояние миграций
+func withMigrationLock(ctx context.Context, dbpool *pgxpool.Pool, fn func(conn *pgxpool.Conn, states []MigrationState) error) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := dbpool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name VARCHAR(255) not null,
+		applied_at TIMESTAMPTZ not null DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		appliedAt[version] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, migration := range migrations {
+		state := MigrationState{Migration: migration}
+		if at, ok := appliedAt[migration.Version]; ok {
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+
+	return fn(conn, states)
+}
+
+// Выполняет скрипт миграции и запись в schema_migrations одной транзакцией
+func runMigration(ctx context.Context, conn *pgxpool.Conn, script string, bookkeeping string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// без параметров pgx выполняет скрипт из нескольких команд простым протоколом
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
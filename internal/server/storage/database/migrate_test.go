@@ -0,0 +1,77 @@
+package database
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, migration := range migrations {
+		require.Equal(t, int64(i+1), migration.Version, "версии миграций идут подряд")
+		require.NotEmpty(t, migration.Up)
+		require.NotEmpty(t, migration.Down)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []Migration
+		wantErr bool
+	}{
+		{
+			name: "sorted_by_version",
+			files: fstest.MapFS{
+				"0010_second.up.sql":   {Data: []byte("up 10")},
+				"0010_second.down.sql": {Data: []byte("down 10")},
+				"0002_first.up.sql":    {Data: []byte("up 2")},
+				"0002_first.down.sql":  {Data: []byte("down 2")},
+			},
+			want: []Migration{
+				{Version: 2, Name: "first", Up: "up 2", Down: "down 2"},
+				{Version: 10, Name: "second", Up: "up 10", Down: "down 10"},
+			},
+		},
+		{
+			name: "missing_down",
+			files: fstest.MapFS{
+				"0001_first.up.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "name_mismatch",
+			files: fstest.MapFS{
+				"0001_first.up.sql":     {Data: []byte("up")},
+				"0001_another.down.sql": {Data: []byte("down")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad_file_name",
+			files: fstest.MapFS{
+				"first.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, migrations)
+		})
+	}
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metrics (
+	id VARCHAR(50) UNIQUE,
+	metric_type VARCHAR(10) not null,
+	delta BIGINT DEFAULT NULL,
+	gauge double precision DEFAULT NULL,
+	hash VARCHAR(64) DEFAULT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS metrics_history (
+	id VARCHAR(50) not null,
+	metric_type VARCHAR(10) not null,
+	delta BIGINT DEFAULT NULL,
+	gauge double precision DEFAULT NULL,
+	created_at TIMESTAMPTZ not null DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS metrics_history_id_created_at_idx ON metrics_history (id, created_at);
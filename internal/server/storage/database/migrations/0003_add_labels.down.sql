@@ -0,0 +1,13 @@
+-- метрики с метками без колонки labels неотличимы от метрик без меток
+DELETE FROM metrics WHERE labels <> '{}'::jsonb;
+DELETE FROM metrics_history WHERE labels <> '{}'::jsonb;
+
+DROP INDEX IF EXISTS metrics_history_metric_key_created_at_idx;
+CREATE INDEX IF NOT EXISTS metrics_history_id_created_at_idx ON metrics_history (id, created_at);
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS metric_key;
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS labels;
+
+DROP INDEX IF EXISTS metrics_metric_key_idx;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_key UNIQUE (id);
+ALTER TABLE metrics DROP COLUMN IF EXISTS metric_key;
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
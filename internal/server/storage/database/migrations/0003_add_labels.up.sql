@@ -0,0 +1,14 @@
+-- уникальность метрики переносится с id на metric_key: имя и набор меток
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB not null DEFAULT '{}';
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS metric_key VARCHAR(255);
+UPDATE metrics SET metric_key = id WHERE metric_key IS NULL;
+ALTER TABLE metrics ALTER COLUMN metric_key SET not null;
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_metric_key_idx ON metrics (metric_key);
+
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS labels JSONB not null DEFAULT '{}';
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS metric_key VARCHAR(255);
+UPDATE metrics_history SET metric_key = id WHERE metric_key IS NULL;
+ALTER TABLE metrics_history ALTER COLUMN metric_key SET not null;
+DROP INDEX IF EXISTS metrics_history_id_created_at_idx;
+CREATE INDEX IF NOT EXISTS metrics_history_metric_key_created_at_idx ON metrics_history (metric_key, created_at);
@@ -0,0 +1,8 @@
+ALTER TABLE metrics_history ALTER COLUMN id TYPE VARCHAR(50);
+
+ALTER TABLE metrics DROP CONSTRAINT metrics_pkey;
+CREATE UNIQUE INDEX metrics_metric_key_idx ON metrics (metric_key);
+ALTER TABLE metrics DROP COLUMN updated_at;
+ALTER TABLE metrics DROP COLUMN created_at;
+ALTER TABLE metrics ALTER COLUMN id DROP not null;
+ALTER TABLE metrics ALTER COLUMN id TYPE VARCHAR(50);
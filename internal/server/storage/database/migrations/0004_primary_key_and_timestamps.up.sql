@@ -0,0 +1,8 @@
+ALTER TABLE metrics ALTER COLUMN id TYPE VARCHAR(255);
+ALTER TABLE metrics ALTER COLUMN id SET not null;
+ALTER TABLE metrics ADD COLUMN created_at TIMESTAMPTZ not null DEFAULT now();
+ALTER TABLE metrics ADD COLUMN updated_at TIMESTAMPTZ not null DEFAULT now();
+-- уникальный индекс по metric_key становится первичным ключом
+ALTER TABLE metrics ADD CONSTRAINT metrics_pkey PRIMARY KEY USING INDEX metrics_metric_key_idx;
+
+ALTER TABLE metrics_history ALTER COLUMN id TYPE VARCHAR(255);
@@ -0,0 +1,2 @@
+ALTER TABLE metrics_history ALTER COLUMN metric_key TYPE VARCHAR(255);
+ALTER TABLE metrics ALTER COLUMN metric_key TYPE VARCHAR(255);
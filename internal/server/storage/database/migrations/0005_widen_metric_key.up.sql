@@ -0,0 +1,3 @@
+-- ключ с метками длиннее имени метрики, 255 символов может не хватить
+ALTER TABLE metrics ALTER COLUMN metric_key TYPE TEXT;
+ALTER TABLE metrics_history ALTER COLUMN metric_key TYPE TEXT;
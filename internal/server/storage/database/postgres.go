@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/region23/go-musthave-devops/internal/serializers"
@@ -16,7 +18,6 @@ import (
 )
 
 type InDatabase struct {
-	mu     sync.Mutex
 	dbpool *pgxpool.Pool
 	key    string
 }
@@ -29,53 +30,55 @@ func NewInDatabase(dbpool *pgxpool.Pool, key string) storage.Repository {
 }
 
 // проверяем есть ли соединение с базой данных
-func Ping(dbpool *pgxpool.Pool) error {
+func Ping(ctx context.Context, dbpool *pgxpool.Pool) error {
 	if dbpool == nil {
 		return errors.New("connection is nil")
 	}
 
-	err := dbpool.Ping(context.Background())
+	err := dbpool.Ping(ctx)
 	if err != nil {
-		return err
+		return storageError(err)
 	}
 
 	return nil
 }
 
-// При инициализации базы данных проверить, есть ли таблица metrics.
-// Если её нет, то создать.
+// Ошибки соединения с базой отдаём как storage.ErrUnavailable, а истечение
+// срока контекста - как есть, чтобы сервер мог ответить 503 или 504
+func storageError(err error) error {
+	switch {
+	case err == nil, errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return err
+	case pgconn.Timeout(err), pgconn.SafeToRetry(err):
+		return fmt.Errorf("%w: %v", storage.ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
+// При инициализации базы данных применяем все новые миграции схемы
 func InitDB(dbpool *pgxpool.Pool) error {
-	query := `CREATE TABLE IF NOT EXISTS metrics (
-		id VARCHAR(50) UNIQUE,
-		metric_type VARCHAR(10) not null,
-		delta BIGINT DEFAULT NULL,
-		gauge double precision DEFAULT NULL,
-		hash VARCHAR(64) DEFAULT NULL
-	  );`
-
-	ctx, cancelfunc := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancelfunc := context.WithTimeout(context.Background(), time.Minute)
 	defer cancelfunc()
 
-	_, err := dbpool.Exec(ctx, query)
+	_, err := MigrateUp(ctx, dbpool)
 	if err != nil {
-		log.Error().Err(err).Msg("Error when creating product table")
+		log.Error().Err(err).Msg("Error when migrating database schema")
 		return err
 	}
 
-	//rows := res.RowsAffected()
-	//log.Printf("Rows affected when creating table: %d", rows)
 	return nil
 }
 
 // извлекает метрику из базы данных
-func (storage *InDatabase) Get(key string) (*serializers.Metric, error) {
-	row := storage.dbpool.QueryRow(context.Background(),
-		`SELECT id, metric_type, delta, gauge, hash FROM metrics WHERE id = $1`,
+func (storage *InDatabase) Get(ctx context.Context, key string) (*serializers.Metric, error) {
+	row := storage.dbpool.QueryRow(ctx,
+		`SELECT id, metric_type, delta, gauge, hash, labels FROM metrics WHERE metric_key = $1`,
 		key)
 
 	var metric serializers.Metric
 
-	err := row.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &metric.Hash)
+	err := row.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &metric.Hash, &metric.Labels)
 
 	switch err {
 	case nil:
@@ -83,77 +86,207 @@ func (storage *InDatabase) Get(key string) (*serializers.Metric, error) {
 	case pgx.ErrNoRows:
 		return nil, pgx.ErrNoRows
 	default:
-		return nil, err
+		return nil, storageError(err)
 	}
 
 }
 
-func (storage *InDatabase) Put(metric serializers.Metric) error {
-	// если это counter, то извлекаем из базы последнее значение счетчика и увеличиваем его на значение метрики
-	if metric.MType == "counter" {
-		storage.mu.Lock()
-		defer storage.mu.Unlock()
-		metricFromDB, err := storage.Get(metric.ID)
-		if err != nil && err != pgx.ErrNoRows {
+func (s *InDatabase) Put(ctx context.Context, metric serializers.Metric) error {
+	return s.PutBatch(ctx, []serializers.Metric{metric})
+}
+
+// Сколько строк вставляем одним INSERT, чтобы не упереться в лимит параметров запроса
+const batchRows = 1000
+
+// Сохраняет пачку метрик одной транзакцией: многострочный upsert в metrics
+// и многострочная вставка в историю. При любой ошибке не сохраняется ничего.
+// Счётчики увеличиваются в самом запросе, поэтому несколько экземпляров
+// сервера могут писать в одну базу
+func (s *InDatabase) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	return storageError(s.putBatch(ctx, metrics))
+}
+
+func (s *InDatabase) putBatch(ctx context.Context, metrics []serializers.Metric) error {
+	if err := storage.ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	// одна строка не может обновиться дважды в одном INSERT ... ON CONFLICT,
+	// а одинаковый порядок блокировки строк исключает взаимные блокировки транзакций
+	metrics = storage.MergeBatch(metrics)
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Key() < metrics[j].Key()
+	})
+
+	tx, err := s.dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	metricRows := make([][]interface{}, 0, len(metrics))
+	for _, metric := range metrics {
+		metricRows = append(metricRows, []interface{}{metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash, labelsOrEmpty(metric.Labels), metric.Key()})
+	}
+
+	// итоговые значения счётчиков после увеличения. Строка с другим типом
+	// не обновляется и не возвращается - это конфликт типов
+	counters := make(map[string]int64, len(metrics))
+	for _, rows := range chunks(metricRows) {
+		query, args := valuesQuery(
+			`INSERT INTO metrics (id, metric_type, delta, gauge, hash, labels, metric_key) VALUES `,
+			` ON CONFLICT (metric_key) DO UPDATE
+	SET delta = COALESCE(metrics.delta, 0) + EXCLUDED.delta, gauge = EXCLUDED.gauge, hash = EXCLUDED.hash, updated_at = now()
+	WHERE metrics.metric_type = EXCLUDED.metric_type
+	RETURNING metric_key, delta`,
+			rows)
+		updated, err := scanCounters(ctx, tx, query, args, counters)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to INSERT metrics to DB")
 			return err
 		}
+		if updated != len(rows) {
+			return fmt.Errorf("%w: %d of %d metrics already have another type", storage.ErrTypeConflict, len(rows)-updated, len(rows))
+		}
+	}
 
-		if err == nil {
-			*metric.Delta = *metricFromDB.Delta + *metric.Delta
-
-			// обновим хэш метрики
-			if storage.key != "" {
-				metric.Hash = serializers.Hash(storage.key, metric.ID, metric.MType, fmt.Sprintf("%d", *metric.Delta))
+	hashRows := [][]interface{}{}
+	historyRows := make([][]interface{}, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.MType == "counter" {
+			delta := counters[metric.Key()]
+			metric.Delta = &delta
+
+			// хэш считаем от итогового значения, пока строка заблокирована транзакцией
+			if s.key != "" {
+				metric.Hash = serializers.Hash(s.key, metric.ID, metric.MType, fmt.Sprintf("%d", *metric.Delta), metric.Labels)
+				hashRows = append(hashRows, []interface{}{metric.Key(), metric.Hash})
 			}
 		}
+
+		historyRows = append(historyRows, []interface{}{metric.ID, metric.MType, metric.Delta, metric.Value, labelsOrEmpty(metric.Labels), metric.Key()})
+	}
+
+	// обновим хэши счётчиков
+	for _, rows := range chunks(hashRows) {
+		query, args := valuesQuery(
+			`UPDATE metrics SET hash = v.hash FROM (VALUES `,
+			`) AS v(metric_key, hash) WHERE metrics.metric_key = v.metric_key`,
+			rows)
+		if _, err := tx.Exec(ctx, query, args...); err != nil {
+			log.Error().Err(err).Msg("Unable to UPDATE metrics hash in DB")
+			return err
+		}
+	}
+
+	// сохраняем значения в историю метрик
+	for _, rows := range chunks(historyRows) {
+		query, args := valuesQuery(
+			`INSERT INTO metrics_history (id, metric_type, delta, gauge, labels, metric_key) VALUES `,
+			``,
+			rows)
+		if _, err := tx.Exec(ctx, query, args...); err != nil {
+			log.Error().Err(err).Msg("Unable to INSERT metrics history to DB")
+			return err
+		}
 	}
 
-	_, err := storage.dbpool.Exec(context.Background(),
-		`INSERT INTO metrics (id, metric_type, delta, gauge, hash) VALUES ($1, $2, $3, $4, $5)
-	ON CONFLICT (id)
-	DO UPDATE 
-	SET delta = $3, gauge = $4, hash = $5;`,
-		metric.ID,
-		metric.MType,
-		metric.Delta,
-		metric.Value,
-		metric.Hash)
+	return tx.Commit(ctx)
+}
 
+// Выполняет upsert, собирает итоговые значения счётчиков по metric_key
+// и возвращает число записанных строк
+func scanCounters(ctx context.Context, tx pgx.Tx, query string, args []interface{}, counters map[string]int64) (int, error) {
+	rows, err := tx.Query(ctx, query, args...)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to INSERT metric to DB")
-		return err
+		return 0, err
 	}
+	defer rows.Close()
 
-	return nil
+	updated := 0
+	for rows.Next() {
+		var key string
+		var delta *int64
+		if err := rows.Scan(&key, &delta); err != nil {
+			return updated, err
+		}
+		if delta != nil {
+			counters[key] = *delta
+		}
+		updated++
+	}
+
+	return updated, rows.Err()
 }
 
-func (storage *InDatabase) All() (map[string]serializers.Metric, error) {
-	rows, err := storage.dbpool.Query(context.Background(),
-		`SELECT id, metric_type, delta, gauge, hash FROM metrics`)
+// Разбивает строки на части по batchRows
+func chunks(rows [][]interface{}) [][][]interface{} {
+	var parts [][][]interface{}
+	for start := 0; start < len(rows); start += batchRows {
+		end := start + batchRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		parts = append(parts, rows[start:end])
+	}
+	return parts
+}
+
+// Собирает запрос вида prefix ($1, $2), ($3, $4) suffix и его параметры
+func valuesQuery(prefix, suffix string, rows [][]interface{}) (string, []interface{}) {
+	var query strings.Builder
+	query.WriteString(prefix)
+	args := make([]interface{}, 0, len(rows)*len(rows[0]))
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for j, value := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, value)
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteString(")")
+	}
+	query.WriteString(suffix)
+
+	return query.String(), args
+}
+
+func (storage *InDatabase) All(ctx context.Context) (map[string]serializers.Metric, error) {
+	rows, err := storage.dbpool.Query(ctx,
+		`SELECT id, metric_type, delta, gauge, hash, labels FROM metrics`)
 
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
+	defer rows.Close()
 
 	metrics := make(map[string]serializers.Metric)
 
 	for rows.Next() {
 		var metric serializers.Metric
-		err := rows.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &metric.Hash)
+		err := rows.Scan(&metric.ID, &metric.MType, &metric.Delta, &metric.Value, &metric.Hash, &metric.Labels)
 		if err != nil {
-			return nil, err
+			return nil, storageError(err)
 		}
 
-		metrics[metric.ID] = metric
+		metrics[metric.Key()] = metric
 	}
 
-	return metrics, rows.Err()
+	return metrics, storageError(rows.Err())
 
 }
 
-func (storage *InDatabase) UpdateAll(m map[string]serializers.Metric) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (storage *InDatabase) UpdateAll(ctx context.Context, m map[string]serializers.Metric) error {
+	return storageError(storage.updateAll(ctx, m))
+}
+
+func (storage *InDatabase) updateAll(ctx context.Context, m map[string]serializers.Metric) error {
 	tx, err := storage.dbpool.Begin(ctx)
 	if err != nil {
 		return err
@@ -161,7 +294,7 @@ func (storage *InDatabase) UpdateAll(m map[string]serializers.Metric) error {
 
 	defer tx.Rollback(ctx)
 
-	err = storage.deleteAll(tx)
+	err = storage.deleteAll(ctx, tx)
 	if err != nil {
 		return err
 	}
@@ -169,12 +302,12 @@ func (storage *InDatabase) UpdateAll(m map[string]serializers.Metric) error {
 	rows := [][]interface{}{}
 
 	for _, metric := range m {
-		rows = append(rows, []interface{}{metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash})
+		rows = append(rows, []interface{}{metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash, labelsOrEmpty(metric.Labels), metric.Key()})
 	}
 
 	_, err = tx.CopyFrom(ctx,
 		pgx.Identifier{"metrics"},
-		[]string{"id", "metric_type", "delta", "gauge", "hash"},
+		[]string{"id", "metric_type", "delta", "gauge", "hash", "labels", "metric_key"},
 		pgx.CopyFromRows(rows),
 	)
 
@@ -184,7 +317,7 @@ func (storage *InDatabase) UpdateAll(m map[string]serializers.Metric) error {
 
 	_, err = storage.dbpool.CopyFrom(ctx,
 		pgx.Identifier{"metrics"},
-		[]string{"id", "metric_type", "delta", "gauge", "hash"},
+		[]string{"id", "metric_type", "delta", "gauge", "hash", "labels", "metric_key"},
 		pgx.CopyFromRows(rows),
 	)
 
@@ -196,9 +329,56 @@ func (storage *InDatabase) UpdateAll(m map[string]serializers.Metric) error {
 
 }
 
+// извлекает историю значений метрики за период [from, to]
+func (s *InDatabase) History(ctx context.Context, key string, from, to time.Time) ([]storage.Sample, error) {
+	if _, err := s.Get(ctx, key); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT created_at, delta, gauge FROM metrics_history WHERE metric_key = $1`
+	args := []interface{}{key}
+	if !from.IsZero() {
+		args = append(args, from)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		query += fmt.Sprintf(" AND created_at <= $%d", len(args))
+	}
+	query += " ORDER BY created_at"
+
+	rows, err := s.dbpool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer rows.Close()
+
+	samples := []storage.Sample{}
+
+	for rows.Next() {
+		var sample storage.Sample
+		err := rows.Scan(&sample.Timestamp, &sample.Delta, &sample.Value)
+		if err != nil {
+			return nil, storageError(err)
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, storageError(rows.Err())
+}
+
+// В колонку labels пишем пустой объект вместо JSON null
+func labelsOrEmpty(labels map[string]string) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+	return labels
+}
+
 // Удаляет все записи из таблицы metrics
-func (storage *InDatabase) deleteAll(tx pgx.Tx) error {
-	ct, err := tx.Exec(context.Background(), `DELETE FROM metrics`)
+func (storage *InDatabase) deleteAll(ctx context.Context, tx pgx.Tx) error {
+	ct, err := tx.Exec(ctx, `DELETE FROM metrics`)
 
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to DELETE metrics from DB")
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValuesQuery(t *testing.T) {
+	query, args := valuesQuery(
+		`UPDATE metrics SET hash = v.hash FROM (VALUES `,
+		`) AS v(metric_key, hash) WHERE metrics.metric_key = v.metric_key`,
+		[][]interface{}{{"a", "hash-a"}, {"b", "hash-b"}})
+
+	require.Equal(t, `UPDATE metrics SET hash = v.hash FROM (VALUES ($1, $2), ($3, $4)) AS v(metric_key, hash) WHERE metrics.metric_key = v.metric_key`, query)
+	require.Equal(t, []interface{}{"a", "hash-a", "b", "hash-b"}, args)
+}
+
+func TestChunks(t *testing.T) {
+	rows := make([][]interface{}, batchRows*2+1)
+	parts := chunks(rows)
+	require.Len(t, parts, 3)
+	require.Len(t, parts[0], batchRows)
+	require.Len(t, parts[2], 1)
+
+	require.Empty(t, chunks(nil))
+}
+
+// Подключается к базе из DATABASE_DSN, без неё тест пропускается
+func testPool(t *testing.T) *pgxpool.Pool {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN не задана")
+	}
+
+	dbpool, err := pgxpool.Connect(context.Background(), dsn)
+	require.NoError(t, err)
+	t.Cleanup(dbpool.Close)
+
+	require.NoError(t, InitDB(dbpool))
+	return dbpool
+}
+
+func TestConcurrentPutBatch(t *testing.T) {
+	dbpool := testPool(t)
+	repository := NewInDatabase(dbpool, "")
+	ctx := context.Background()
+
+	id := fmt.Sprintf("testConcurrent%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		dbpool.Exec(context.Background(), `DELETE FROM metrics WHERE id = $1`, id)
+		dbpool.Exec(context.Background(), `DELETE FROM metrics_history WHERE id = $1`, id)
+	})
+
+	const batches = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*batches)
+	for worker := 0; worker < 2; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < batches; i++ {
+				delta := int64(1)
+				errs <- repository.PutBatch(ctx, []serializers.Metric{
+					{ID: id, MType: "counter", Delta: &delta},
+					{ID: id, MType: "counter", Delta: &delta},
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// ни одно увеличение не потерялось между транзакциями
+	metric, err := repository.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*2*batches), *metric.Delta)
+
+	// счётчик не перезаписывается метрикой другого типа
+	value := 1.5
+	err = repository.PutBatch(ctx, []serializers.Metric{{ID: id, MType: "gauge", Value: &value}})
+	require.ErrorIs(t, err, storage.ErrTypeConflict)
+}
@@ -1,72 +1,305 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/rs/zerolog/log"
 )
 
+// Версия формата файла снэпшота
+const snapshotVersion = 1
+
+var ErrCorruptSnapshot = errors.New("snapshot file is corrupt")
+
+// Заголовок снэпшота - первая строка файла. Checksum - sha256 тела в hex
+type snapshotHeader struct {
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+	Size     int    `json:"size"`
+}
+
+// Producer записывает снэпшоты атомарно: во временный файл рядом с основным,
+// fsync и rename. Предыдущие снэпшоты остаются в файлах name.1, name.2, ...
 type Producer struct {
-	mu      sync.Mutex
-	file    *os.File
-	encoder *json.Encoder
+	mu       sync.Mutex
+	fileName string
+	// сколько снэпшотов хранить, считая текущий
+	retain int
 }
 
-func NewProducer(fileName string) (*Producer, error) {
-	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0777)
+func NewProducer(fileName string, retain int) (*Producer, error) {
+	if retain < 1 {
+		retain = 1
+	}
+
+	removeTemps(fileName)
+
+	// проверяем, что в каталог можно писать, до первого сохранения
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
 	if err != nil {
 		return nil, err
 	}
+	file.Close()
+	os.Remove(file.Name())
+
 	return &Producer{
-		file:    file,
-		encoder: json.NewEncoder(file),
+		fileName: fileName,
+		retain:   retain,
 	}, nil
 }
 
-func (p *Producer) WriteMetrics(metrics map[string]serializers.Metric) error {
+func (p *Producer) WriteMetrics(snapshot Snapshot) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if metrics != nil {
-		return p.encoder.Encode(metrics)
+	if snapshot.Metrics == nil {
+		return errors.New("can't write metric to file from memory - object is empty")
+	}
+
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	header, err := json.Marshal(snapshotHeader{Version: snapshotVersion, Checksum: hex.EncodeToString(sum[:]), Size: len(body)})
+	if err != nil {
+		return err
+	}
+
+	tmpName, err := writeTemp(p.fileName, append(append(header, '\n'), body...))
+	if err != nil {
+		return err
+	}
+
+	p.rotate()
+
+	if err := os.Rename(tmpName, p.fileName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return syncDir(filepath.Dir(p.fileName))
+}
+
+// Пишет данные во временный файл рядом с fileName и сбрасывает их на диск
+func writeTemp(fileName string, data []byte) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// Удаляет временные файлы, оставшиеся от записи, прерванной падением сервера
+func removeTemps(fileName string) {
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		return
+	}
+
+	prefix := filepath.Base(fileName) + ".tmp-"
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		name := filepath.Join(filepath.Dir(fileName), entry.Name())
+		if err := os.Remove(name); err != nil {
+			log.Warn().Err(err).Msgf("Не смогли удалить временный файл %s", name)
+		}
+	}
+}
+
+// Сдвигает сохранённые снэпшоты: name.1 -> name.2, ..., а текущий файл
+// становится name.1. Текущий файл не переименовывается, а связывается
+// жёсткой ссылкой, чтобы по основному имени всегда лежал целый снэпшот
+func (p *Producer) rotate() {
+	if p.retain < 2 {
+		return
+	}
+	if _, err := os.Stat(p.fileName); err != nil {
+		return
+	}
+
+	for i := p.retain - 1; i > 1; i-- {
+		err := os.Rename(retainedName(p.fileName, i-1), retainedName(p.fileName, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Msg("Не смогли сдвинуть старый снэпшот")
+		}
+	}
+
+	previous := retainedName(p.fileName, 1)
+	os.Remove(previous)
+	if err := os.Link(p.fileName, previous); err != nil {
+		log.Warn().Err(err).Msg("Не смогли сохранить предыдущий снэпшот")
 	}
-	return errors.New("can't write metric to file from memory - object is empty")
+}
+
+// Имя i-го предыдущего снэпшота
+func retainedName(fileName string, i int) string {
+	return fmt.Sprintf("%s.%d", fileName, i)
+}
+
+// Сбрасывает на диск запись каталога после rename
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
 }
 
 func (p *Producer) Close() error {
-	return p.file.Close()
+	return nil
 }
 
 type consumer struct {
-	mu      sync.Mutex
-	file    *os.File
-	decoder *json.Decoder
+	mu       sync.Mutex
+	fileName string
 }
 
 func NewConsumer(fileName string) (*consumer, error) {
-	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0777)
+	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
+	file.Close()
+
 	return &consumer{
-		file:    file,
-		decoder: json.NewDecoder(file),
+		fileName: fileName,
 	}, nil
 }
-func (c *consumer) ReadMetrics() (map[string]serializers.Metric, error) {
+
+// ReadLatest читает только последний снэпшот, без отката на предыдущие.
+// С журналом откат недопустим: журнал очищен при записи последнего снэпшота,
+// и пачки между ним и предыдущим потерялись бы молча
+func (c *consumer) ReadLatest() (Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return readSnapshot(c.fileName)
+}
+
+// Читает последний снэпшот. Если он повреждён, откатывается на предыдущие name.1, name.2, ...
+func (c *consumer) ReadMetrics() (Snapshot, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	metrics := map[string]serializers.Metric{}
-	if err := c.decoder.Decode(&metrics); err != nil {
-		if !errors.Is(err, io.EOF) {
-			return nil, err
+
+	snapshot, err := readSnapshot(c.fileName)
+	if err == nil {
+		return snapshot, nil
+	}
+
+	for i := 1; ; i++ {
+		name := retainedName(c.fileName, i)
+		if _, statErr := os.Stat(name); statErr != nil {
+			return Snapshot{}, err
+		}
+
+		log.Warn().Err(err).Msgf("Снэпшот не прочитан, пробуем предыдущий %s", name)
+		previous, prevErr := readSnapshot(name)
+		if prevErr == nil {
+			return previous, nil
 		}
+		err = prevErr
 	}
-	return metrics, nil
 }
+
+func readSnapshot(fileName string) (Snapshot, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return Snapshot{Metrics: map[string]serializers.Metric{}}, nil
+	}
+
+	line, body, _ := bytes.Cut(data, []byte("\n"))
+	var header snapshotHeader
+	if json.Unmarshal(line, &header) != nil || header.Version == 0 {
+		return readLegacySnapshot(data)
+	}
+
+	if header.Version != snapshotVersion {
+		return Snapshot{}, fmt.Errorf("неизвестная версия снэпшота %d", header.Version)
+	}
+
+	sum := sha256.Sum256(body)
+	if len(body) != header.Size || hex.EncodeToString(sum[:]) != header.Checksum {
+		return Snapshot{}, fmt.Errorf("%w: %s", ErrCorruptSnapshot, fileName)
+	}
+
+	return decodeSnapshot(body)
+}
+
+// Файлы до появления заголовка содержат дописанные друг за другом JSON-документы.
+// Берём последний целый документ - он самый свежий
+func readLegacySnapshot(data []byte) (Snapshot, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	var last json.RawMessage
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if last == nil {
+				return Snapshot{}, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+			}
+			// оборванный при записи последний документ
+			break
+		}
+		last = raw
+	}
+
+	return decodeSnapshot(last)
+}
+
+func decodeSnapshot(raw []byte) (Snapshot, error) {
+	snapshot := Snapshot{}
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+
+	// Файлы старого формата содержат только мапу с метриками без истории
+	if snapshot.Metrics == nil {
+		snapshot.Metrics = map[string]serializers.Metric{}
+		if err := json.Unmarshal(raw, &snapshot.Metrics); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	return snapshot, nil
+}
+
 func (c *consumer) Close() error {
-	return c.file.Close()
+	return nil
 }
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeSnapshot(value float64) Snapshot {
+	return Snapshot{Metrics: map[string]serializers.Metric{
+		"Alloc": {ID: "Alloc", MType: "gauge", Value: &value},
+	}}
+}
+
+func readAlloc(t *testing.T, fileName string) float64 {
+	consumer, err := NewConsumer(fileName)
+	require.NoError(t, err)
+	defer consumer.Close()
+
+	snapshot, err := consumer.ReadMetrics()
+	require.NoError(t, err)
+	return *snapshot.Metrics["Alloc"].Value
+}
+
+func TestSnapshotRetain(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	producer, err := NewProducer(fileName, 3)
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, producer.WriteMetrics(gaugeSnapshot(float64(i))))
+	}
+	require.NoError(t, producer.Close())
+
+	require.Equal(t, float64(4), readAlloc(t, fileName))
+	require.Equal(t, float64(3), readAlloc(t, fileName+".1"))
+	require.Equal(t, float64(2), readAlloc(t, fileName+".2"))
+	require.NoFileExists(t, fileName+".3")
+
+	// временные файлы не остаются
+	matches, err := filepath.Glob(fileName + ".tmp-*")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func TestSnapshotCorruptFallback(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	producer, err := NewProducer(fileName, 2)
+	require.NoError(t, err)
+	require.NoError(t, producer.WriteMetrics(gaugeSnapshot(1)))
+	require.NoError(t, producer.WriteMetrics(gaugeSnapshot(2)))
+
+	// портим тело текущего снэпшота, заголовок с контрольной суммой остаётся прежним
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	data[len(data)-3] = '9'
+	require.NoError(t, os.WriteFile(fileName, data, 0644))
+
+	_, err = readSnapshot(fileName)
+	require.ErrorIs(t, err, ErrCorruptSnapshot)
+	require.Equal(t, float64(1), readAlloc(t, fileName))
+
+	// без отката повреждённый снэпшот - ошибка
+	consumer, err := NewConsumer(fileName)
+	require.NoError(t, err)
+	_, err = consumer.ReadLatest()
+	require.ErrorIs(t, err, ErrCorruptSnapshot)
+	require.NoError(t, consumer.Close())
+}
+
+func TestStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "metrics.json")
+
+	// остатки записи, прерванной падением
+	stale := fileName + ".tmp-123"
+	require.NoError(t, os.WriteFile(stale, []byte("{"), 0644))
+	other := filepath.Join(dir, "other.json.tmp-123")
+	require.NoError(t, os.WriteFile(other, []byte("{"), 0644))
+
+	_, err := NewProducer(fileName, 1)
+	require.NoError(t, err)
+	require.NoFileExists(t, stale)
+	require.FileExists(t, other)
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want float64
+	}{
+		{
+			name: "appended_documents",
+			data: `{"metrics":{"Alloc":{"id":"Alloc","type":"gauge","value":1}}}` + "\n" +
+				`{"metrics":{"Alloc":{"id":"Alloc","type":"gauge","value":2}}}` + "\n",
+			want: 2,
+		},
+		{
+			name: "torn_last_document",
+			data: `{"metrics":{"Alloc":{"id":"Alloc","type":"gauge","value":1}}}` + "\n" +
+				`{"metrics":{"Alloc":{"id":"Al`,
+			want: 1,
+		},
+		{
+			name: "metrics_map_only",
+			data: `{"Alloc":{"id":"Alloc","type":"gauge","value":3}}` + "\n",
+			want: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "metrics.json")
+			require.NoError(t, os.WriteFile(fileName, []byte(tt.data), 0644))
+			require.Equal(t, tt.want, readAlloc(t, fileName))
+		})
+	}
+}
+
+func TestEmptySnapshot(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	consumer, err := NewConsumer(fileName)
+	require.NoError(t, err)
+	snapshot, err := consumer.ReadMetrics()
+	require.NoError(t, err)
+	require.Empty(t, snapshot.Metrics)
+	require.NotNil(t, snapshot.Metrics)
+}
@@ -1,23 +1,30 @@
 package storage
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/region23/go-musthave-devops/internal/serializers"
 )
 
+// Сколько последних значений каждой метрики храним в памяти
+const historyLimit = 10000
+
 type InMemory struct {
 	mu sync.Mutex
 	m  map[string]serializers.Metric
+	h  map[string][]Sample
 }
 
-func NewInMemory() Repository {
+func NewInMemory() *InMemory {
 	return &InMemory{
 		m: make(map[string]serializers.Metric),
+		h: make(map[string][]Sample),
 	}
 }
 
-func (s *InMemory) Get(key string) (*serializers.Metric, error) {
+func (s *InMemory) Get(ctx context.Context, key string) (*serializers.Metric, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if v, ok := s.m[key]; ok {
@@ -26,33 +33,145 @@ func (s *InMemory) Get(key string) (*serializers.Metric, error) {
 	return nil, ErrNotFound
 }
 
-func (s *InMemory) Put(metric serializers.Metric) error {
+func (s *InMemory) Put(ctx context.Context, metric serializers.Metric) error {
+	return s.PutBatch(ctx, []serializers.Metric{metric})
+}
+
+// Сохраняет пачку метрик под одной блокировкой, предварительно проверив все метрики
+func (s *InMemory) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	if err := ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	return s.putBatch(metrics, time.Now())
+}
+
+// Сохраняет проверенную пачку с отметкой времени now. Повторы одной метрики
+// схлопываются, как в базе, чтобы история не зависела от хранилища.
+// Если тип метрики расходится с сохранённым, пачка не сохраняется целиком
+func (s *InMemory) putBatch(metrics []serializers.Metric, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkTypes(metrics); err != nil {
+		return err
+	}
+
+	for _, metric := range MergeBatch(metrics) {
+		s.put(metric, now)
+	}
+	return nil
+}
+
+// CheckTypes проверяет типы метрик пачки по сохранённым метрикам
+func (s *InMemory) CheckTypes(metrics []serializers.Metric) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if curMetric, ok := s.m[metric.ID]; ok {
+	return s.checkTypes(metrics)
+}
+
+func (s *InMemory) checkTypes(metrics []serializers.Metric) error {
+	for _, metric := range metrics {
+		if err := CheckType(metric, s.m[metric.Key()].MType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemory) put(metric serializers.Metric, now time.Time) {
+	key := metric.Key()
+	if curMetric, ok := s.m[key]; ok {
 		if metric.MType == "counter" {
-			*curMetric.Delta = *curMetric.Delta + *metric.Delta
-			s.m[metric.ID] = curMetric
-			return nil
+			delta := *curMetric.Delta + *metric.Delta
+			curMetric.Delta = &delta
+			metric = curMetric
 		}
 	}
 
-	s.m[metric.ID] = metric
-	return nil
+	s.m[key] = metric
+	s.appendSample(key, NewSample(metric, now))
+}
+
+// Добавляет значение в историю метрики, отбрасывая самые старые при превышении лимита
+func (s *InMemory) appendSample(key string, sample Sample) {
+	samples := append(s.h[key], sample)
+	if len(samples) > historyLimit {
+		samples = samples[len(samples)-historyLimit:]
+	}
+	s.h[key] = samples
 }
 
 // All values in map
-func (s *InMemory) All() (map[string]serializers.Metric, error) {
+// Копия метрик: вызывающий перебирает её без блокировки, пока идут записи
+func (s *InMemory) All(ctx context.Context) (map[string]serializers.Metric, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m, nil
+
+	metrics := make(map[string]serializers.Metric, len(s.m))
+	for k, v := range s.m {
+		metrics[k] = v
+	}
+	return metrics, nil
 }
 
 // Обновляет мапу с метриками в памяти снэпшотом данных из файла
-func (s *InMemory) UpdateAll(m map[string]serializers.Metric) error {
+func (s *InMemory) UpdateAll(ctx context.Context, m map[string]serializers.Metric) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.m = m
 	return nil
 }
+
+func (s *InMemory) History(ctx context.Context, key string, from, to time.Time) ([]Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.m[key]; !ok {
+		return nil, ErrNotFound
+	}
+
+	samples := []Sample{}
+	for _, sample := range s.h[key] {
+		if sample.InRange(from, to) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+// Снэпшот метрик и их истории для сохранения в файл
+func (s *InMemory) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := make(map[string]serializers.Metric, len(s.m))
+	for k, v := range s.m {
+		metrics[k] = v
+	}
+
+	history := make(map[string][]Sample, len(s.h))
+	for k, v := range s.h {
+		history[k] = append([]Sample(nil), v...)
+	}
+
+	return Snapshot{Metrics: metrics, History: history}
+}
+
+// Восстанавливает метрики и их историю из снэпшота
+func (s *InMemory) Restore(snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snapshot.Metrics == nil {
+		snapshot.Metrics = make(map[string]serializers.Metric)
+	}
+	if snapshot.History == nil {
+		snapshot.History = make(map[string][]Sample)
+	}
+
+	s.m = snapshot.Metrics
+	s.h = snapshot.History
+	return nil
+}
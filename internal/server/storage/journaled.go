@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+)
+
+// Journaled - хранилище в памяти, которое записывает каждую принятую пачку
+// в журнал до того, как ответить, и восстанавливается из снэпшота и журнала.
+// Чтение идёт напрямую из памяти
+type Journaled struct {
+	*InMemory
+	wal *WAL
+
+	// запись пачек. Сжатие и восстановление берут её блокировку, чтобы
+	// снэпшот совпадал с номером последней записи журнала
+	writer *Synchronous
+}
+
+func NewJournaled(mem *InMemory, wal *WAL) *Journaled {
+	return &Journaled{InMemory: mem, wal: wal, writer: NewSynchronous(mem, wal)}
+}
+
+func (j *Journaled) Put(ctx context.Context, metric serializers.Metric) error {
+	return j.PutBatch(ctx, []serializers.Metric{metric})
+}
+
+// Пачка попадает в память только после успешной записи в журнал
+func (j *Journaled) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	return j.writer.PutBatch(ctx, metrics)
+}
+
+// Recover восстанавливает память из снэпшота и дописывает записи журнала,
+// которые новее снэпшота. Без restore журнал очищается
+func (j *Journaled) Recover(snapshot Snapshot, records []WALRecord, restore bool) (replayed int, err error) {
+	j.writer.mu.Lock()
+	defer j.writer.mu.Unlock()
+
+	// номера новых записей должны быть больше номера в снэпшоте,
+	// иначе при следующем восстановлении они будут пропущены
+	j.wal.advance(snapshot.WALSeq)
+
+	if !restore {
+		return 0, j.wal.Truncate()
+	}
+
+	if err := j.Restore(snapshot); err != nil {
+		return 0, err
+	}
+
+	for _, record := range records {
+		if record.Seq <= snapshot.WALSeq {
+			continue
+		}
+		if err := ValidateBatch(record.Metrics); err != nil {
+			return replayed, err
+		}
+		if err := j.putBatch(record.Metrics, record.Timestamp); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// Compact сохраняет снэпшот памяти и очищает вошедший в него журнал
+func (j *Journaled) Compact(producer *Producer) error {
+	j.writer.mu.Lock()
+	defer j.writer.mu.Unlock()
+
+	snapshot := j.Snapshot()
+	snapshot.WALSeq = j.wal.Seq()
+	if err := producer.WriteMetrics(snapshot); err != nil {
+		return err
+	}
+
+	return j.wal.Truncate()
+}
+
+// Close закрывает журнал
+func (j *Journaled) Close() error {
+	return j.wal.Close()
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/region23/go-musthave-devops/internal/serializers"
 )
@@ -9,11 +12,125 @@ import (
 var (
 	ErrNotFound      = errors.New("not found")
 	ErrAlreadyExists = errors.New("already exists")
+	ErrInvalidMetric = errors.New("invalid metric")
+	// Метрика с тем же ключом уже сохранена с другим типом
+	ErrTypeConflict = errors.New("metric type conflict")
+	// Хранилище временно недоступно, например потеряно соединение с базой
+	ErrUnavailable = errors.New("storage unavailable")
 )
 
+// Хранилище метрик. Метрики адресуются ключом serializers.Metric.Key(): имя и набор меток.
+// Отмена ctx или истечение его срока прерывает обращение к хранилищу
 type Repository interface {
-	Get(key string) (*serializers.Metric, error)
-	Put(metric serializers.Metric) error
-	All() (map[string]serializers.Metric, error)
-	UpdateAll(m map[string]serializers.Metric) error
+	Get(ctx context.Context, key string) (*serializers.Metric, error)
+	Put(ctx context.Context, metric serializers.Metric) error
+	// Атомарно сохраняет пачку метрик: либо все, либо ни одной
+	PutBatch(ctx context.Context, metrics []serializers.Metric) error
+	All(ctx context.Context) (map[string]serializers.Metric, error)
+	UpdateAll(ctx context.Context, m map[string]serializers.Metric) error
+	// История значений метрики за период [from, to]. Нулевое время означает отсутствие границы.
+	History(ctx context.Context, key string, from, to time.Time) ([]Sample, error)
+}
+
+// Значение метрики, принятое сервером в момент Timestamp.
+// Для counter хранится накопленное значение счётчика после обновления.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+}
+
+// Снэпшот хранилища, который сохраняется в файл
+type Snapshot struct {
+	Metrics map[string]serializers.Metric `json:"metrics"`
+	History map[string][]Sample           `json:"history,omitempty"`
+	// Номер последней записи журнала, вошедшей в снэпшот
+	WALSeq uint64 `json:"wal_seq,omitempty"`
+}
+
+// Validate проверяет, что у метрики есть значение нужного типа
+func Validate(metric serializers.Metric) error {
+	switch {
+	case metric.MType == "counter" && metric.Delta != nil:
+		return nil
+	case metric.MType == "gauge" && metric.Value != nil:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s %q without value", ErrInvalidMetric, metric.MType, metric.ID)
+	}
+}
+
+// ValidateBatch проверяет все метрики пачки до того, как что-либо сохранить,
+// в том числе что одна метрика не приходит в пачке с разными типами
+func ValidateBatch(metrics []serializers.Metric) error {
+	types := make(map[string]string, len(metrics))
+	for _, metric := range metrics {
+		if err := Validate(metric); err != nil {
+			return err
+		}
+		if err := CheckType(metric, types[metric.Key()]); err != nil {
+			return err
+		}
+		types[metric.Key()] = metric.MType
+	}
+	return nil
+}
+
+// CheckType проверяет, что тип метрики совпадает с уже сохранённым stored.
+// Пустой stored - метрики ещё нет
+func CheckType(metric serializers.Metric, stored string) error {
+	if stored != "" && stored != metric.MType {
+		return fmt.Errorf("%w: %q is %s, not %s", ErrTypeConflict, metric.Key(), stored, metric.MType)
+	}
+	return nil
+}
+
+// MergeBatch схлопывает повторы одной метрики в пачке: приращения счётчиков
+// складываются, для gauge остаётся последнее значение. Порядок первых вхождений сохраняется
+func MergeBatch(metrics []serializers.Metric) []serializers.Metric {
+	merged := make([]serializers.Metric, 0, len(metrics))
+	index := make(map[string]int, len(metrics))
+
+	for _, metric := range metrics {
+		key := metric.Key()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, metric)
+			continue
+		}
+
+		if metric.MType == "counter" && merged[i].MType == "counter" {
+			delta := *merged[i].Delta + *metric.Delta
+			metric.Delta = &delta
+		}
+		merged[i] = metric
+	}
+
+	return merged
+}
+
+// NewSample создаёт отметку со значением метрики на момент ts
+func NewSample(metric serializers.Metric, ts time.Time) Sample {
+	sample := Sample{Timestamp: ts}
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		sample.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		sample.Value = &value
+	}
+	return sample
+}
+
+// InRange проверяет, попадает ли отметка в период [from, to]
+func (s Sample) InRange(from, to time.Time) bool {
+	if !from.IsZero() && s.Timestamp.Before(from) {
+		return false
+	}
+	if !to.IsZero() && s.Timestamp.After(to) {
+		return false
+	}
+	return true
 }
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+)
+
+// Synchronous - хранилище, которое записывает каждую пачку в журнал до того,
+// как она попадёт в repository и обработчик ответит. С политикой
+// WALSyncAlways пачка к ответу уже на диске. Используется при STORE_INTERVAL=0
+type Synchronous struct {
+	Repository
+	wal *WAL
+
+	// запись в журнал и в repository идут под одной блокировкой, чтобы
+	// порядок пачек в журнале совпадал с порядком их применения
+	mu sync.Mutex
+}
+
+// Хранилище, которое проверяет типы метрик до записи, см. InMemory.CheckTypes
+type typeChecker interface {
+	CheckTypes(metrics []serializers.Metric) error
+}
+
+// Хранилище, которое сохраняет пачку с отметкой времени записи журнала
+type timedBatcher interface {
+	putBatch(metrics []serializers.Metric, now time.Time) error
+}
+
+// NewSynchronous оборачивает repository, пачки пишутся в wal
+func NewSynchronous(repository Repository, wal *WAL) *Synchronous {
+	return &Synchronous{Repository: repository, wal: wal}
+}
+
+func (s *Synchronous) Put(ctx context.Context, metric serializers.Metric) error {
+	return s.PutBatch(ctx, []serializers.Metric{metric})
+}
+
+// Пачка попадает в repository только после успешной записи в журнал,
+// поэтому при ошибке записи откатывать нечего
+func (s *Synchronous) PutBatch(ctx context.Context, metrics []serializers.Metric) error {
+	if err := ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// пачка с конфликтом типов не должна попасть в журнал,
+	// иначе на ней остановится восстановление
+	if checker, ok := s.Repository.(typeChecker); ok {
+		if err := checker.CheckTypes(metrics); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if _, err := s.wal.Append(metrics, now); err != nil {
+		return err
+	}
+
+	if batcher, ok := s.Repository.(timedBatcher); ok {
+		return batcher.putBatch(metrics, now)
+	}
+	return s.Repository.PutBatch(ctx, metrics)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynchronousPersistsBeforeReturn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	wal, _, err := OpenWAL(path, WALSyncAlways, 0)
+	require.NoError(t, err)
+
+	repository := NewSynchronous(NewInMemory(), wal)
+
+	value := 42.5
+	err = repository.Put(context.Background(), serializers.Metric{ID: "Alloc", MType: "gauge", Value: &value})
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	_, records, err := OpenWAL(path, WALSyncNever, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, value, *records[0].Metrics[0].Value)
+}
+
+func TestSynchronousPersistError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	wal, _, err := OpenWAL(path, WALSyncAlways, 0)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	mem := NewInMemory()
+	require.NoError(t, mem.Put(context.Background(), counter("PollCount", 5)))
+	repository := NewSynchronous(mem, wal)
+
+	// конфликт типов не попадает ни в журнал, ни в память
+	value := 1.5
+	err = repository.Put(context.Background(), serializers.Metric{ID: "PollCount", MType: "gauge", Value: &value})
+	require.ErrorIs(t, err, ErrTypeConflict)
+	require.Equal(t, uint64(0), wal.Seq())
+
+	// незаписанная в журнал пачка не применяется, повтор от агента не удвоит счётчик
+	errDisk := errors.New("disk full")
+	wal.failed = errDisk
+	err = repository.PutBatch(context.Background(), []serializers.Metric{counter("PollCount", 1)})
+	require.ErrorIs(t, err, errDisk)
+
+	metric, err := repository.Get(context.Background(), "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), *metric.Delta)
+
+	history, err := repository.History(context.Background(), "PollCount", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/rs/zerolog/log"
+)
+
+// Политика сброса журнала на диск
+type WALSync string
+
+const (
+	// fsync после каждой записи, ответ агенту уходит после сброса на диск
+	WALSyncAlways WALSync = "always"
+	// fsync в фоне раз в интервал, при отказе питания теряется не больше интервала
+	WALSyncInterval WALSync = "interval"
+	// сброс на диск остаётся операционной системе
+	WALSyncNever WALSync = "never"
+)
+
+// ParseWALSync проверяет название политики сброса журнала
+func ParseWALSync(value string) (WALSync, error) {
+	switch policy := WALSync(value); policy {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("неизвестная политика сброса журнала %q, ожидается always, interval или never", value)
+	}
+}
+
+// Запись журнала: пачка метрик в том виде, в каком её принял сервер
+type WALRecord struct {
+	Seq       uint64               `json:"seq"`
+	Timestamp time.Time            `json:"ts"`
+	Metrics   []serializers.Metric `json:"metrics"`
+}
+
+// WAL - журнал упреждающей записи: по одной JSON-строке на принятую пачку
+type WAL struct {
+	mu     sync.Mutex
+	file   *os.File
+	policy WALSync
+	seq    uint64
+	// длина целой части файла: после неудачной записи файл обрезается до неё
+	size int64
+	// есть записи, ещё не сброшенные на диск
+	dirty bool
+	// журнал не удалось вернуть к целому состоянию, новые записи не принимаются
+	failed error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenWAL открывает журнал на дозапись и возвращает уцелевшие записи.
+// Оборванная при падении последняя строка отбрасывается
+func OpenWAL(path string, policy WALSync, interval time.Duration) (*WAL, []WALRecord, error) {
+	if policy == WALSyncInterval && interval <= 0 {
+		return nil, nil, fmt.Errorf("интервал сброса журнала должен быть больше нуля, получен %s", interval)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, size, err := readWAL(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	w := &WAL{file: file, policy: policy, size: size}
+	if len(records) > 0 {
+		w.seq = records[len(records)-1].Seq
+	}
+
+	if policy == WALSyncInterval {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop(interval)
+	}
+
+	return w, records, nil
+}
+
+// Читает записи журнала до первой повреждённой строки. size - длина целой части файла
+func readWAL(r io.Reader) (records []WALRecord, size int64, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warn().Int64("offset", size).Msg("Отбрасываем оборванную запись в конце журнала")
+			}
+			return records, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var record WALRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			log.Warn().Err(err).Int64("offset", size).Msg("Журнал повреждён, отбрасываем его хвост")
+			return records, size, nil
+		}
+
+		records = append(records, record)
+		size += int64(len(line))
+	}
+}
+
+// Append дописывает пачку в журнал и возвращает номер записи.
+// Если запись не удалась, журнал обрезается до прежней длины, чтобы
+// оборванная строка не скрыла следующие записи при чтении
+func (w *WAL) Append(metrics []serializers.Metric, ts time.Time) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed != nil {
+		return 0, w.failed
+	}
+
+	record := WALRecord{Seq: w.seq + 1, Timestamp: ts, Metrics: metrics}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	line = append(line, '\n')
+	if _, err := w.file.Write(line); err != nil {
+		return 0, w.rollback(err)
+	}
+	// без fsync агент не получает ответ, а значит повторит пачку,
+	// поэтому и несброшенную запись нужно убрать
+	if w.policy == WALSyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return 0, w.rollback(err)
+		}
+	} else {
+		w.dirty = true
+	}
+
+	w.seq = record.Seq
+	w.size += int64(len(line))
+
+	return record.Seq, nil
+}
+
+// Возвращает журнал к длине до неудачной записи. Если и это не удалось,
+// журнал перестаёт принимать записи
+func (w *WAL) rollback(cause error) error {
+	if err := w.file.Truncate(w.size); err != nil {
+		w.failed = fmt.Errorf("журнал повреждён после ошибки записи %v: %w", cause, err)
+		return w.failed
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		w.failed = fmt.Errorf("журнал повреждён после ошибки записи %v: %w", cause, err)
+		return w.failed
+	}
+	return cause
+}
+
+// Seq - номер последней записи журнала
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Продолжаем нумерацию не меньше seq, чтобы новые записи были новее снэпшота
+func (w *WAL) advance(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq > w.seq {
+		w.seq = seq
+	}
+}
+
+// Truncate очищает журнал, когда его записи уже попали в снэпшот. Нумерация продолжается
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = 0
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+// Sync сбрасывает записанное на диск
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Error().Err(err).Msg("Не смогли сбросить журнал на диск")
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Close сбрасывает журнал на диск и закрывает файл
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
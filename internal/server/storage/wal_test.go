@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	"github.com/stretchr/testify/require"
+)
+
+func counter(id string, delta int64) serializers.Metric {
+	return serializers.Metric{ID: id, MType: "counter", Delta: &delta}
+}
+
+func TestWALReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	wal, records, err := OpenWAL(path, WALSyncAlways, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	for i := int64(1); i <= 3; i++ {
+		seq, err := wal.Append([]serializers.Metric{counter("PollCount", i)}, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), seq)
+	}
+	require.NoError(t, wal.Close())
+
+	// падение посреди записи оставляет оборванную строку
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"seq":4,"ts":"2026-`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	wal, records, err = OpenWAL(path, WALSyncInterval, time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, int64(3), *records[2].Metrics[0].Delta)
+
+	// оборванная строка отрезана, новая запись продолжает нумерацию
+	seq, err := wal.Append([]serializers.Metric{counter("PollCount", 4)}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), seq)
+	require.NoError(t, wal.Close())
+
+	_, records, err = OpenWAL(path, WALSyncNever, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	_, _, err := OpenWAL(filepath.Join(t.TempDir(), "metrics.wal"), WALSyncInterval, 0)
+	require.Error(t, err)
+}
+
+func TestWALAppendFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	wal, _, err := OpenWAL(path, WALSyncAlways, 0)
+	require.NoError(t, err)
+	_, err = wal.Append([]serializers.Metric{counter("PollCount", 1)}, time.Now())
+	require.NoError(t, err)
+
+	// запись оборвалась посередине строки: хвост отрезается,
+	// следующие записи не теряются за повреждённой строкой
+	_, err = wal.file.WriteString(`{"seq":2,"ts":"2026-`)
+	require.NoError(t, err)
+	errNoSpace := errors.New("no space left on device")
+	require.ErrorIs(t, wal.rollback(errNoSpace), errNoSpace)
+
+	seq, err := wal.Append([]serializers.Metric{counter("PollCount", 2)}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), seq)
+	require.NoError(t, wal.Close())
+
+	wal, records, err := OpenWAL(path, WALSyncAlways, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	// файл, который нельзя ни дописать, ни обрезать, больше не принимает записи
+	file := wal.file
+	wal.file, err = os.Open(path)
+	require.NoError(t, err)
+	_, err = wal.Append([]serializers.Metric{counter("PollCount", 3)}, time.Now())
+	require.Error(t, err)
+	_, err = wal.Append([]serializers.Metric{counter("PollCount", 3)}, time.Now())
+	require.ErrorIs(t, err, wal.failed)
+	require.NoError(t, wal.file.Close())
+	require.NoError(t, file.Close())
+
+	_, records, err = OpenWAL(path, WALSyncNever, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
+
+func TestJournaledRecover(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "metrics.wal")
+	storePath := filepath.Join(dir, "metrics.json")
+	ctx := context.Background()
+
+	wal, _, err := OpenWAL(walPath, WALSyncAlways, 0)
+	require.NoError(t, err)
+	journaled := NewJournaled(NewInMemory(), wal)
+
+	require.NoError(t, journaled.PutBatch(ctx, []serializers.Metric{counter("PollCount", 5)}))
+
+	producer, err := NewProducer(storePath, 1)
+	require.NoError(t, err)
+	require.NoError(t, journaled.Compact(producer))
+	require.NoError(t, producer.Close())
+
+	// после сжатия пачки попадают только в журнал
+	require.NoError(t, journaled.PutBatch(ctx, []serializers.Metric{counter("PollCount", 2)}))
+	require.NoError(t, journaled.Put(ctx, counter("PollCount", 1)))
+	require.Error(t, journaled.PutBatch(ctx, []serializers.Metric{{ID: "broken", MType: "counter"}}))
+	require.NoError(t, journaled.Close())
+
+	consumer, err := NewConsumer(storePath)
+	require.NoError(t, err)
+	snapshot, err := consumer.ReadMetrics()
+	require.NoError(t, err)
+	require.NoError(t, consumer.Close())
+	require.Equal(t, uint64(1), snapshot.WALSeq)
+
+	wal, records, err := OpenWAL(walPath, WALSyncAlways, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	restored := NewJournaled(NewInMemory(), wal)
+	replayed, err := restored.Recover(snapshot, records, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, replayed)
+
+	metric, err := restored.Get(ctx, "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, int64(8), *metric.Delta)
+
+	history, err := restored.History(ctx, "PollCount", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+
+	// запись из журнала, уже вошедшая в снэпшот, повторно не применяется
+	consumer, err = NewConsumer(storePath)
+	require.NoError(t, err)
+	snapshot, err = consumer.ReadMetrics()
+	require.NoError(t, err)
+	require.NoError(t, consumer.Close())
+
+	snapshot.WALSeq = 3
+	_, err = restored.Recover(snapshot, records, true)
+	require.NoError(t, err)
+	metric, err = restored.Get(ctx, "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), *metric.Delta)
+
+	// нумерация продолжается после номера из снэпшота
+	seq, err := wal.Append([]serializers.Metric{counter("PollCount", 1)}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), seq)
+	require.NoError(t, restored.Close())
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/region23/go-musthave-devops/internal/serializers"
+	mw "github.com/region23/go-musthave-devops/internal/server/middleware"
+	"github.com/region23/go-musthave-devops/internal/server/storage"
+)
+
+// Ошибки проверки метрик, общие для HTTP и gRPC
+var (
+	ErrUnsupportedType = errors.New("Не поддерживаемый тип метрики")
+	ErrEmptyID         = errors.New("Metric name can't be empty")
+	ErrEmptyValue      = errors.New("Value can't be nil")
+	ErrInvalidHash     = errors.New("hash is not valid")
+	ErrMissingHash     = errors.New("metric is not signed")
+	ErrUnknownAgent    = errors.New("agent has no active key")
+	ErrStorage         = errors.New("Ошибка при сохранении метрики")
+)
+
+// Проверяем метрику, пришедшую от агента: тип, имя, значение и хэш.
+// При signed=true метрика без хэша отклоняется
+func validateMetric(keys []string, signed bool, metric *serializers.Metric) error {
+	if metric.MType != "gauge" && metric.MType != "counter" {
+		return ErrUnsupportedType
+	}
+
+	if metric.ID == "" {
+		return ErrEmptyID
+	}
+
+	if (metric.MType == "counter" && metric.Delta == nil) || (metric.MType == "gauge" && metric.Value == nil) {
+		return ErrEmptyValue
+	}
+
+	if signed && (metric.Hash == "" || metric.Hash == "none") {
+		return ErrMissingHash
+	}
+
+	// Если хэш не пустой, то сверяем хэши
+	if _, err := checkHash(keys, metric); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Ключи, которыми может быть подписана метрика агента из контекста.
+// Агент из реестра с истёкшими ключами, как и неизвестный агент при пустом
+// общем ключе, получает ErrUnknownAgent
+func (s *Server) agentKeys(ctx context.Context) ([]string, error) {
+	if s.Keys == nil {
+		return serverKeys(s.Key), nil
+	}
+
+	keys, known := s.Keys.Keys(mw.AgentIdentityFrom(ctx))
+	if !known && s.Key != "" {
+		return serverKeys(s.Key), nil
+	}
+	if len(keys) == 0 {
+		return nil, ErrUnknownAgent
+	}
+
+	return keys, nil
+}
+
+// Метрики агента из реестра без подписи не принимаются, иначе его ключ
+// можно обойти, просто не подписывая метрики
+func (s *Server) agentSigns(ctx context.Context) bool {
+	if s.Keys == nil {
+		return false
+	}
+
+	_, known := s.Keys.Keys(mw.AgentIdentityFrom(ctx))
+	return known
+}
+
+// Ошибка проверки одной метрики пачки
+type ItemError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// BatchError - пачка отклонена целиком. Unwrap отдаёт ошибку первой
+// неверной метрики, по ней выбирается статус ответа
+type BatchError struct {
+	Items []ItemError
+	first error
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Items) == 1 {
+		return e.first.Error()
+	}
+	return fmt.Sprintf("%v (и ещё ошибок: %d)", e.first, len(e.Items)-1)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.first
+}
+
+// Проверяем все метрики пачки и сохраняем её целиком, если ошибок нет.
+// Используется HTTP- и gRPC-ручками
+func (s *Server) saveMetrics(ctx context.Context, metrics []serializers.Metric) error {
+	keys, err := s.agentKeys(ctx)
+	if err != nil {
+		s.reject(ctx)
+		return err
+	}
+
+	// тело запроса подписано целиком, старые хэши отдельных метрик не нужны.
+	// Непроверенные хэши не сохраняем, чтобы их не приняли за подпись сервера
+	signed := s.agentSigns(ctx)
+	if mw.SignedFrom(ctx) {
+		keys, signed = nil, false
+		for i := range metrics {
+			metrics[i].Hash = ""
+		}
+	}
+
+	var batchErr *BatchError
+	invalidHash := false
+	for i := range metrics {
+		if err := validateMetric(keys, signed, &metrics[i]); err != nil {
+			if batchErr == nil {
+				batchErr = &BatchError{first: err}
+			}
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, ID: metrics[i].ID, Error: err.Error()})
+			invalidHash = invalidHash || errors.Is(err, ErrInvalidHash) || errors.Is(err, ErrMissingHash)
+		}
+	}
+
+	if batchErr != nil {
+		if invalidHash {
+			s.reject(ctx)
+		}
+		return batchErr
+	}
+
+	// write metrics to repository
+	ctx, cancel := s.storageContext(ctx)
+	defer cancel()
+	if err := s.storage.PutBatch(ctx, metrics); err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+// Ошибка хранилища для ответа агенту. Неверная метрика и конфликт типов -
+// ошибки клиента, недоступность хранилища остаётся как есть, чтобы выбрать
+// статус 503 или 504, остальное - сбой записи на сервере, ErrStorage
+func storageError(err error) error {
+	switch {
+	case storageUnavailable(err), errors.Is(err, storage.ErrInvalidMetric), errors.Is(err, storage.ErrTypeConflict):
+		return err
+	default:
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+}
+
+// Учитываем отклонённую подпись в счётчике агента
+func (s *Server) reject(ctx context.Context) {
+	if s.Keys != nil {
+		s.Keys.Reject(mw.AgentIdentityFrom(ctx))
+	}
+}
+
+// HTTP-статус ответа для ошибки сохранения метрики
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupportedType):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrEmptyID):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnknownAgent):
+		return http.StatusForbidden
+	case errors.Is(err, ErrStorage):
+		return http.StatusInternalServerError
+	default:
+		return storageStatus(err, http.StatusBadRequest)
+	}
+}